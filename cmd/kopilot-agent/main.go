@@ -23,48 +23,37 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/hashicorp/yamux"
 	"github.com/namsral/flag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/smartxworks/kopilot/pkg/agent"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
 )
 
 func main() {
-	connectURL := ""
-	flag.StringVar(&connectURL, "connect", connectURL, "connect URL of kopilot-hub")
-	apiserverAddr := "kubernetes.default"
-	flag.StringVar(&apiserverAddr, "apiserver", apiserverAddr, "kube-apiserver address")
+	agent.InitFlags(flag.CommandLine)
 	flag.Parse()
 
-	dialer := websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	wsConn, _, err := dialer.Dial(connectURL, nil)
-	if err != nil {
-		log.Fatalf("failed to dial hub %q: %s", connectURL, err)
-	}
-
-	sess, err := yamux.Client(wsConn.UnderlyingConn(), nil)
-	if err != nil {
-		log.Fatalf("failed to create multiplex channel: %s", err)
-	}
-
-	log.Println("connected to hub")
-
-	apiserverURL, err := url.Parse(fmt.Sprintf("https://%s", apiserverAddr))
+	apiserverURL, err := url.Parse(fmt.Sprintf("https://%s", agent.C.APIServerAddr))
 	if err != nil {
 		log.Fatalf("failed to parse apiserver URL: %s", err)
 	}
 
 	apiserverProxy := httputil.NewSingleHostReverseProxy(apiserverURL)
+	// flush as soon as data arrives, so watch events are not held back in buffers
+	apiserverProxy.FlushInterval = -1
 
 	saDir := "/run/secrets/kubernetes.io/serviceaccount"
 	token, err := os.ReadFile(filepath.Join(saDir, "token"))
@@ -85,16 +74,105 @@ func main() {
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{
+		Host:        apiserverURL.String(),
+		BearerToken: string(token),
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: caCert,
+		},
+	})
+	if err != nil {
+		log.Fatalf("failed to create Kubernetes client: %s", err)
+	}
+
+	hello, err := agent.NewHello(context.Background(), kubeClient)
+	if err != nil {
+		log.Fatalf("failed to describe member cluster: %s", err)
+	}
+
+	if agent.C.PolicyRequired && agent.C.PolicyFile == "" {
+		log.Fatalf("policy-required is set without a policy-file")
+	}
+	policyEnforcer, err := agent.NewPolicyEnforcer(agent.C.PolicyFile, agent.C.PolicyRequired)
+	if err != nil {
+		log.Fatalf("failed to load policy: %s", err)
+	}
+
+	hubs, err := agent.Hubs()
+	if err != nil {
+		log.Fatalf("failed to load hubs: %s", err)
+	}
+
+	var hubSessions *agent.HubSessions
+	serviceProxy := agent.NewServiceProxy(policyEnforcer)
+	endpointForwarder := agent.NewEndpointForwarder(policyEnforcer)
+	hostServiceForwarder := agent.NewHostServiceForwarder(kubeClient, policyEnforcer, func(hub string) (net.Conn, error) {
+		return hubSessions.DialHub(hub)
+	})
+
 	apiserverProxy.Transport = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
 		TLSClientConfig: &tls.Config{
 			RootCAs: caCertPool,
+			// upgraded connections (exec, attach, port-forward) require HTTP/1.1
+			NextProtos: []string{"http/1.1"},
 		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
 	}
 
+	controlHandler := agent.NewControlHandler(kubeClient, policyEnforcer, serviceProxy, endpointForwarder, hostServiceForwarder)
+	apiserverHandler := policyEnforcer.Enforce(agent.Compress(apiserverProxy))
+	compressedServiceProxy := agent.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceProxy.ServeService(w, r, agent.HubFromContext(r.Context()), strings.TrimPrefix(r.Header.Get(tunnel.TargetHeader), tunnel.TargetServicePrefix))
+	}))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get(tunnel.TargetHeader)
+		switch {
+		case target == "":
+			apiserverHandler.ServeHTTP(w, r)
+		case target == tunnel.TargetControl:
+			controlHandler.ServeHTTP(w, r)
+		case strings.HasPrefix(target, tunnel.TargetServicePrefix):
+			compressedServiceProxy.ServeHTTP(w, r)
+		case strings.HasPrefix(target, tunnel.TargetEndpointPrefix):
+			endpointForwarder.ServeEndpoint(w, r, agent.HubFromContext(r.Context()), strings.TrimPrefix(target, tunnel.TargetEndpointPrefix))
+		default:
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+		}
+	})
+
+	// no read or write timeouts: streams carry watches and interactive sessions of arbitrary length
 	server := &http.Server{
-		Handler: apiserverProxy,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       90 * time.Second,
+	}
+
+	hubSessions, err = agent.NewHubSessions(hubs, hello, server, func(hub agent.Hub, hubHello *tunnel.HubHello) {
+		if err := serviceProxy.SetServices(hub.Name, hubHello.Services); err != nil {
+			log.Printf("failed to set services of hub %q: %s", hub.Name, err)
+		}
+		if err := endpointForwarder.SetEndpoints(hub.Name, hubHello.Endpoints); err != nil {
+			log.Printf("failed to set endpoints of hub %q: %s", hub.Name, err)
+		}
+		if hubHello.HasFeature(tunnel.FeatureReverseTunnel) {
+			if err := hostServiceForwarder.SetHostServices(context.Background(), hub.Name, hubHello.HostServices); err != nil {
+				log.Printf("failed to set host services of hub %q: %s", hub.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		log.Fatalf("failed to create hub sessions: %s", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	go policyEnforcer.Run(ctx, agent.C.PolicyInterval)
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -105,13 +183,30 @@ func main() {
 		if err := server.Shutdown(context.Background()); err != nil {
 			log.Printf("failed to shutdown server: %s", err)
 		}
+		cancel()
 		close(idleConnsClosed)
 	}()
 
-	log.Println("starting apiserver proxy")
-	if err := server.Serve(sess); err != nil {
-		log.Fatalf("error running apiserver proxy: %s", err)
+	if agent.C.HealthBindAddr != "" {
+		healthServer := &http.Server{
+			Addr:    agent.C.HealthBindAddr,
+			Handler: healthHandler(hubSessions),
+		}
+		go func() {
+			if err := healthServer.ListenAndServe(); err != nil {
+				log.Fatalf("error running health server: %s", err)
+			}
+		}()
 	}
 
+	log.Printf("starting apiserver proxy for %d hub(s)", len(hubs))
+	hubSessions.Run(ctx)
+
 	<-idleConnsClosed
 }
+
+func healthHandler(hubSessions *agent.HubSessions) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", hubSessions)
+	return mux
+}
@@ -22,14 +22,20 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/namsral/flag"
 	subresourceserver "github.com/smartxworks/kubernetes-subresource-server-runtime"
 	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+	"github.com/smartxworks/kopilot/pkg/client/clientset/versioned/scheme"
+	informers "github.com/smartxworks/kopilot/pkg/client/informers/externalversions"
 	"github.com/smartxworks/kopilot/pkg/hub"
 	"github.com/smartxworks/kopilot/pkg/hub/cluster"
 	"github.com/smartxworks/kopilot/pkg/hub/peer"
@@ -39,6 +45,14 @@ func main() {
 	hub.InitFlags(flag.CommandLine)
 	flag.Parse()
 
+	publicURL, err := hub.PublicURL()
+	if err != nil {
+		log.Fatalf("invalid public-addr: %s", err)
+	}
+	if publicURL != nil && hub.C.PublicBindAddr == "" {
+		log.Fatalf("public-addr %q is the URL of the public listener, which is disabled without public-bind", hub.C.PublicAddr)
+	}
+
 	cfg, err := clientcmd.BuildConfigFromFlags("", "")
 	if err != nil {
 		log.Fatalf("failed to build kubeconfig: %s", err)
@@ -54,13 +68,29 @@ func main() {
 		log.Fatalf("failed to create client: %s", err)
 	}
 
-	sessioManager := cluster.NewSessionManager()
 	peerManager := peer.NewManager(kubeClient)
 
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kopilot-hub"})
+
+	informerFactory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	clusterInformer := informerFactory.Kopilot().V1alpha1().Clusters()
+	clusterLister := clusterInformer.Lister()
+	sessioManager := cluster.NewSessionManager(clusterLister)
+	cluster.NewSessionController(clusterInformer, sessioManager, recorder)
+	agentController := cluster.NewAgentController(client, clusterInformer, sessioManager, recorder)
+	probeController := cluster.NewProbeController(client, clusterInformer, sessioManager, peerManager, recorder)
+
 	s := subresourceserver.New(kubeClient)
-	s.AddSubresource(cluster.NewAgentSubresource(client))
-	s.AddSubresource(cluster.NewConnectSubresource(client, sessioManager))
-	s.AddSubresource(cluster.NewProxySubresource(client, sessioManager, peerManager))
+	s.AddSubresource(cluster.NewAgentSubresource(clusterLister))
+	s.AddSubresource(cluster.NewConnectSubresource(clusterLister, sessioManager))
+	requestLimiter := cluster.NewRequestLimiter(clusterInformer)
+	s.AddSubresource(cluster.NewProxySubresource(clusterLister, sessioManager, peerManager, requestLimiter, cluster.NewDiscoveryCache()))
+	s.AddSubresource(cluster.NewServicesSubresource(clusterLister, sessioManager, peerManager, requestLimiter))
+	s.AddSubresource(cluster.NewEndpointsSubresource(clusterLister, sessioManager, peerManager, requestLimiter))
+	s.AddSubresource(cluster.NewKubeconfigSubresource(kubeClient, clusterLister))
+	s.AddSubresource(cluster.NewFanoutSubresource(kubeClient, clusterLister, sessioManager, peerManager, requestLimiter))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	shutdownHandler := make(chan os.Signal, 2)
@@ -72,6 +102,13 @@ func main() {
 		os.Exit(1)
 	}()
 
+	informerFactory.Start(ctx.Done())
+	for informerType, synced := range informerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			log.Fatalf("failed to sync cache of %s", informerType)
+		}
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
 		if err := s.Start(ctx); err != nil {
@@ -80,10 +117,28 @@ func main() {
 		return nil
 	})
 	g.Go(func() error {
-		if err := peer.StartServer(ctx, client, sessioManager); err != nil {
+		if err := peer.StartServer(ctx, clusterLister, sessioManager); err != nil {
 			log.Fatalf("error running peer server: %s", err)
 		}
 		return nil
 	})
+	g.Go(func() error {
+		if err := cluster.StartPublicServer(ctx, clusterLister, sessioManager); err != nil {
+			log.Fatalf("error running public server: %s", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		return agentController.Start(ctx)
+	})
+	g.Go(func() error {
+		return probeController.Start(ctx)
+	})
+	g.Go(func() error {
+		if err := hub.StartMetricsServer(ctx); err != nil {
+			log.Fatalf("error running metrics server: %s", err)
+		}
+		return nil
+	})
 	g.Wait()
 }
@@ -0,0 +1,211 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/namsral/flag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+
+	hubcluster "github.com/smartxworks/kopilot/pkg/hub/cluster"
+)
+
+// memberOptions are the flags to connect to a member cluster.
+type memberOptions struct {
+	kubeconfig string
+	context    string
+}
+
+func (m *memberOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&m.kubeconfig, "member-kubeconfig", m.kubeconfig, "path to the kubeconfig of the member cluster")
+	fs.StringVar(&m.context, "member-context", m.context, "kubeconfig context of the member cluster")
+}
+
+func (m *memberOptions) clients() (dynamic.Interface, meta.RESTMapper, error) {
+	if m.kubeconfig == "" {
+		return nil, nil, fmt.Errorf("-member-kubeconfig is required")
+	}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(&clientcmd.ClientConfigLoadingRules{
+		ExplicitPath: m.kubeconfig,
+	}, &clientcmd.ConfigOverrides{
+		CurrentContext: m.context,
+	}).ClientConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("load member kubeconfig: %s", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create member client: %s", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create member discovery client: %s", err)
+	}
+	return dynamicClient, restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)), nil
+}
+
+func runInstall(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	m := &memberOptions{}
+	m.addFlags(fs)
+	timeout := 30 * time.Second
+	fs.DurationVar(&timeout, "timeout", timeout, "how long to wait for the token to be assigned")
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	name, err := requireName(args)
+	if err != nil {
+		return err
+	}
+
+	token, err := waitForToken(ctx, o, name, timeout)
+	if err != nil {
+		return err
+	}
+	objs, err := fetchAgentManifests(ctx, o, name, token)
+	if err != nil {
+		return err
+	}
+	dynamicClient, mapper, err := m.clients()
+	if err != nil {
+		return err
+	}
+
+	force := true
+	for _, obj := range objs {
+		ri, err := resourceInterface(dynamicClient, mapper, obj)
+		if err != nil {
+			return err
+		}
+		data, err := obj.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("encode %s %q: %s", obj.GetKind(), obj.GetName(), err)
+		}
+		if _, err := ri.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+			FieldManager: "kopilotctl",
+			Force:        &force,
+		}); err != nil {
+			return fmt.Errorf("apply %s %q: %s", obj.GetKind(), obj.GetName(), err)
+		}
+		fmt.Printf("%s %q applied\n", obj.GetKind(), obj.GetName())
+	}
+	return nil
+}
+
+func runUninstall(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	m := &memberOptions{}
+	m.addFlags(fs)
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	name, err := requireName(args)
+	if err != nil {
+		return err
+	}
+	return uninstallAgent(ctx, o, m, name)
+}
+
+// uninstallAgent deletes the objects rendered by the agent subresource from
+// the member cluster, in reverse order so that the namespace goes last.
+func uninstallAgent(ctx context.Context, o *options, m *memberOptions, name string) error {
+	cluster, err := o.client.KopilotV1alpha1().Clusters(o.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get cluster: %s", err)
+	}
+	objs, err := fetchAgentManifests(ctx, o, name, cluster.Token)
+	if err != nil {
+		return err
+	}
+	dynamicClient, mapper, err := m.clients()
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	for i := len(objs) - 1; i >= 0; i-- {
+		obj := objs[i]
+		ri, err := resourceInterface(dynamicClient, mapper, obj)
+		if err != nil {
+			return err
+		}
+		if err := ri.Delete(ctx, obj.GetName(), metav1.DeleteOptions{
+			PropagationPolicy: &propagation,
+		}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete %s %q: %s", obj.GetKind(), obj.GetName(), err)
+		}
+		fmt.Printf("%s %q deleted\n", obj.GetKind(), obj.GetName())
+	}
+	return nil
+}
+
+func fetchAgentManifests(ctx context.Context, o *options, name string, token string) ([]*unstructured.Unstructured, error) {
+	key := types.NamespacedName{
+		Namespace: o.namespace,
+		Name:      name,
+	}
+	data, err := o.kubeClient.Discovery().RESTClient().Get().AbsPath(hubcluster.NewAgentSubresource(nil).Path(key)).Param("token", token).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get agent manifests: %s", err)
+	}
+
+	var objs []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode agent manifests: %s", err)
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func resourceInterface(dynamicClient dynamic.Interface, mapper meta.RESTMapper, obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, fmt.Errorf("map %s: %s", gvk, err)
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return dynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+	}
+	return dynamicClient.Resource(mapping.Resource), nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/namsral/flag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	hubcluster "github.com/smartxworks/kopilot/pkg/hub/cluster"
+)
+
+func runRegister(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	timeout := 30 * time.Second
+	fs.DurationVar(&timeout, "timeout", timeout, "how long to wait for the token to be assigned")
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	name, err := requireName(args)
+	if err != nil {
+		return err
+	}
+
+	cluster := &kopilotv1alpha1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: o.namespace,
+			Name:      name,
+		},
+	}
+	if _, err := o.client.KopilotV1alpha1().Clusters(o.namespace).Create(ctx, cluster, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("create cluster: %s", err)
+	}
+
+	if _, err := waitForToken(ctx, o, name, timeout); err != nil {
+		return err
+	}
+	fmt.Printf("cluster %q registered\n", fmt.Sprintf("%s/%s", o.namespace, name))
+	return nil
+}
+
+// waitForToken waits until the webhook has assigned a token to the cluster.
+func waitForToken(ctx context.Context, o *options, name string, timeout time.Duration) (string, error) {
+	var token string
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		cluster, err := o.client.KopilotV1alpha1().Clusters(o.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		token = cluster.Token
+		return token != "", nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("wait for token of cluster %q: %s", fmt.Sprintf("%s/%s", o.namespace, name), err)
+	}
+	return token, nil
+}
+
+func runStatus(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	timeout := 10 * time.Second
+	fs.DurationVar(&timeout, "timeout", timeout, "timeout of probing each cluster")
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+
+	var clusters []kopilotv1alpha1.Cluster
+	switch len(args) {
+	case 0:
+		clusterList, err := o.client.KopilotV1alpha1().Clusters(o.namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("list clusters: %s", err)
+		}
+		clusters = clusterList.Items
+	case 1:
+		cluster, err := o.client.KopilotV1alpha1().Clusters(o.namespace).Get(ctx, args[0], metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("get cluster: %s", err)
+		}
+		clusters = append(clusters, *cluster)
+	default:
+		return fmt.Errorf("at most one cluster name is allowed")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tVERSION\tMESSAGE")
+	for _, cluster := range clusters {
+		key := types.NamespacedName{
+			Namespace: cluster.Namespace,
+			Name:      cluster.Name,
+		}
+		info, err := probeCluster(ctx, o, key, timeout)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\tDisconnected\t\t%s\n", cluster.Name, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tConnected\t%s\t\n", cluster.Name, info.GitVersion)
+	}
+	return tw.Flush()
+}
+
+// probeCluster fetches the version of a member cluster through the proxy
+// subresource, which succeeds only if an agent of the cluster is connected.
+func probeCluster(ctx context.Context, o *options, key types.NamespacedName, timeout time.Duration) (*version.Info, error) {
+	proxyPath := hubcluster.NewProxySubresource(nil, nil, nil, nil, nil).Path(key)
+	data, err := o.kubeClient.Discovery().RESTClient().Get().AbsPath(proxyPath, "version").Timeout(timeout).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var info version.Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("decode version: %s", err)
+	}
+	return &info, nil
+}
+
+func runKubeconfig(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	all := false
+	fs.BoolVar(&all, "all", all, "include all clusters the current user may proxy")
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	name, err := requireName(args)
+	if err != nil {
+		return err
+	}
+
+	key := types.NamespacedName{
+		Namespace: o.namespace,
+		Name:      name,
+	}
+	req := o.kubeClient.Discovery().RESTClient().Get().AbsPath(hubcluster.NewKubeconfigSubresource(nil, nil).Path(key))
+	if all {
+		req = req.Param("all", "true")
+	}
+	data, err := req.DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("get kubeconfig: %s", err)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runDeregister(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	m := &memberOptions{}
+	m.addFlags(fs)
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	name, err := requireName(args)
+	if err != nil {
+		return err
+	}
+
+	if m.kubeconfig != "" {
+		if err := uninstallAgent(ctx, o, m, name); err != nil {
+			return err
+		}
+	}
+
+	if err := o.client.KopilotV1alpha1().Clusters(o.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("delete cluster: %s", err)
+	}
+	fmt.Printf("cluster %q deregistered\n", fmt.Sprintf("%s/%s", o.namespace, name))
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/namsral/flag"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+
+	hubcluster "github.com/smartxworks/kopilot/pkg/hub/cluster"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+func runForward(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error {
+	address := "127.0.0.1"
+	port := 0
+	fs.StringVar(&address, "address", address, "local address to listen on")
+	fs.IntVar(&port, "port", port, "local port to listen on, 0 to pick a free port")
+	args, err := parseCommandFlags(o, fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("a cluster name and an endpoint name are required")
+	}
+
+	key := types.NamespacedName{
+		Namespace: o.namespace,
+		Name:      args[0],
+	}
+	endpoint := args[1]
+
+	config := rest.CopyConfig(o.config)
+	// upgrade requests require HTTP/1.1
+	config.NextProtos = []string{"http/1.1"}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return fmt.Errorf("create transport: %s", err)
+	}
+
+	endpointURL, err := url.Parse(config.Host)
+	if err != nil {
+		return fmt.Errorf("parse host: %s", err)
+	}
+	endpointURL.Path = strings.TrimSuffix(endpointURL.Path, "/") + hubcluster.NewEndpointsSubresource(nil, nil, nil, nil).Path(key) + "/" + endpoint
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("listen: %s", err)
+	}
+	defer listener.Close()
+	fmt.Printf("forwarding %s to endpoint %q of cluster %q\n", listener.Addr(), endpoint, key)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %s", err)
+		}
+		go func() {
+			defer conn.Close()
+			backendConn, err := dialEndpoint(ctx, transport, endpointURL.String())
+			if err != nil {
+				log.Printf("failed to dial endpoint %q: %s", endpoint, err)
+				return
+			}
+			defer backendConn.Close()
+			tunnel.Pipe(conn, backendConn)
+		}()
+	}
+}
+
+// dialEndpoint sends an upgrade request to the endpoints subresource and
+// returns the raw connection to the endpoint it is upgraded to.
+func dialEndpoint(ctx context.Context, transport http.RoundTripper, endpointURL string) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", tunnel.TCPUpgradeProtocol)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upgraded connection is not writable")
+	}
+	return rwc, nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/namsral/flag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+)
+
+// envPrefix prefixes the environment variables flags may also be set with,
+// such as KOPILOTCTL_KUBECONFIG for -kubeconfig.
+const envPrefix = "KOPILOTCTL"
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, o *options, fs *flag.FlagSet, args []string) error
+}
+
+// options are the host cluster connection flags shared by all commands.
+type options struct {
+	kubeconfig string
+	context    string
+	namespace  string
+
+	config     *rest.Config
+	kubeClient kubernetes.Interface
+	client     clientset.Interface
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", o.kubeconfig, "path to the kubeconfig of the host cluster")
+	fs.StringVar(&o.context, "context", o.context, "kubeconfig context of the host cluster")
+	fs.StringVar(&o.namespace, "namespace", o.namespace, "namespace of the Cluster")
+	fs.StringVar(&o.namespace, "n", o.namespace, "shorthand for -namespace")
+}
+
+func (o *options) complete() error {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+		CurrentContext: o.context,
+	})
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return fmt.Errorf("load kubeconfig: %s", err)
+	}
+	o.config = config
+
+	if o.namespace == "" {
+		namespace, _, err := clientConfig.Namespace()
+		if err != nil {
+			return fmt.Errorf("get namespace: %s", err)
+		}
+		o.namespace = namespace
+	}
+
+	if o.kubeClient, err = kubernetes.NewForConfig(config); err != nil {
+		return fmt.Errorf("create Kubernetes client: %s", err)
+	}
+	if o.client, err = clientset.NewForConfig(config); err != nil {
+		return fmt.Errorf("create client: %s", err)
+	}
+	return nil
+}
+
+func main() {
+	// installed as kubectl-kopilot, the binary is invoked by kubectl as "kubectl kopilot"
+	prog := filepath.Base(os.Args[0])
+	if strings.HasPrefix(prog, "kubectl-") {
+		prog = "kubectl " + strings.TrimPrefix(prog, "kubectl-")
+	}
+
+	commands := []command{
+		{"register", "NAME", "create a Cluster and wait for its token", runRegister},
+		{"install", "NAME -member-kubeconfig PATH", "install kopilot-agent into a member cluster", runInstall},
+		{"status", "[NAME]", "show connection status of clusters", runStatus},
+		{"kubeconfig", "NAME [-all]", "print a kubeconfig for member clusters", runKubeconfig},
+		{"forward", "NAME ENDPOINT [-port PORT]", "forward a local port to an endpoint of a member cluster", runForward},
+		{"uninstall", "NAME -member-kubeconfig PATH", "remove kopilot-agent from a member cluster", runUninstall},
+		{"deregister", "NAME [-member-kubeconfig PATH]", "delete a Cluster, uninstalling its agent first if a member kubeconfig is given", runDeregister},
+	}
+
+	o := &options{}
+	fs := flag.NewFlagSetWithEnvPrefix(prog, envPrefix, flag.ExitOnError)
+	o.addFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] COMMAND [ARGS]\n\nCommands:\n", prog)
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name != fs.Arg(0) {
+			continue
+		}
+
+		cfs := flag.NewFlagSetWithEnvPrefix(c.name, envPrefix, flag.ExitOnError)
+		cfs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n\nFlags:\n", prog, c.name, c.args, c.summary)
+			cfs.PrintDefaults()
+		}
+		if err := c.run(context.Background(), o, cfs, fs.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", fs.Arg(0))
+	fs.Usage()
+	os.Exit(2)
+}
+
+// parseCommandFlags parses the flags of a command, which may appear both
+// before and after the positional arguments. Host cluster flags are accepted
+// as well, so that they can also follow the command.
+func parseCommandFlags(o *options, fs *flag.FlagSet, args []string) ([]string, error) {
+	o.addFlags(fs)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if err := o.complete(); err != nil {
+		return nil, err
+	}
+	return positional, nil
+}
+
+func requireName(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("exactly one cluster name is required")
+	}
+	return args[0], nil
+}
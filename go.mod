@@ -8,10 +8,14 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/hashicorp/yamux v0.0.0-20210707203944-259a57b3608c
 	github.com/namsral/flag v1.7.4-pre
+	github.com/prometheus/client_golang v1.11.0
 	github.com/smartxworks/kubernetes-subresource-server-runtime v0.0.0-20210728053230-3b19ada842c4
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	k8s.io/api v0.21.3
 	k8s.io/apimachinery v0.21.3
 	k8s.io/client-go v0.21.3
 	k8s.io/klog/v2 v2.10.0
 	sigs.k8s.io/controller-runtime v0.9.3
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,157 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// minCompressLength is the size below which responses of known length are
+// not worth compressing.
+const minCompressLength = 1024
+
+// Compress wraps h to compress responses as the hub asks for with
+// tunnel.CompressionHeader. Responses the upstream already encoded, such as
+// gzip-encoded ones, are passed through untouched.
+func Compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(tunnel.CompressionHeader)
+		r.Header.Del(tunnel.CompressionHeader)
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		compression, err := tunnel.ParseCompression(value)
+		if err != nil {
+			log.Printf("failed to parse compression %q: %s", value, err)
+			h.ServeHTTP(w, r)
+			return
+		}
+		if compression.Algorithm == tunnel.CompressionNone {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			compression:    compression,
+		}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				log.Printf("failed to finish compressed response: %s", err)
+			}
+		}()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides on WriteHeader whether the response is
+// compressed, and compresses the body written afterwards if so.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	compression tunnel.Compression
+	compressor  tunnel.Compressor
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if shouldCompress(code, w.Header()) {
+		compressor, err := w.compression.NewWriter(w.ResponseWriter)
+		if err != nil {
+			log.Printf("failed to compress response: %s", err)
+		} else {
+			w.compressor = compressor
+			w.Header().Del("Content-Length")
+			w.Header().Set(tunnel.ContentEncodingHeader, w.compression.Algorithm)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compressor == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.compressor.Write(b)
+}
+
+// Flush writes out what was compressed so far, so that watch events are
+// not held back.
+func (w *compressResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compressor != nil {
+		if err := w.compressor.Flush(); err != nil {
+			log.Printf("failed to flush compressed response: %s", err)
+		}
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection of upgraded requests (exec, attach,
+// port-forward) over uncompressed.
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.hijacked || w.compressor == nil {
+		return nil
+	}
+	return w.compressor.Close()
+}
+
+func shouldCompress(code int, header http.Header) bool {
+	switch code {
+	case http.StatusSwitchingProtocols, http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil && n < minCompressLength {
+			return false
+		}
+	}
+	return true
+}
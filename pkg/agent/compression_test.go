@@ -0,0 +1,160 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("kopilot ", 1024)
+	tests := []struct {
+		name            string
+		compression     string
+		code            int
+		contentLength   bool
+		contentEncoding string
+		body            string
+		want            string
+	}{
+		{
+			name: "not asked",
+			code: http.StatusOK,
+			body: large,
+		},
+		{
+			name:        "gzip",
+			compression: "gzip",
+			code:        http.StatusOK,
+			body:        large,
+			want:        tunnel.CompressionGzip,
+		},
+		{
+			name:        "deflate with level",
+			compression: "deflate; level=9",
+			code:        http.StatusOK,
+			body:        large,
+			want:        tunnel.CompressionDeflate,
+		},
+		{
+			name:        "none",
+			compression: "none",
+			code:        http.StatusOK,
+			body:        large,
+		},
+		{
+			name:        "invalid level",
+			compression: "gzip; level=10",
+			code:        http.StatusOK,
+			body:        large,
+		},
+		{
+			name:        "unknown algorithm",
+			compression: "br",
+			code:        http.StatusOK,
+			body:        large,
+		},
+		{
+			name:            "already encoded",
+			compression:     "gzip",
+			code:            http.StatusOK,
+			contentEncoding: "gzip",
+			body:            large,
+		},
+		{
+			name:          "small response",
+			compression:   "gzip",
+			code:          http.StatusOK,
+			contentLength: true,
+			body:          "{}",
+		},
+		{
+			name:          "large response of known length",
+			compression:   "gzip",
+			code:          http.StatusOK,
+			contentLength: true,
+			body:          large,
+			want:          tunnel.CompressionGzip,
+		},
+		{
+			name:        "not modified",
+			compression: "gzip",
+			code:        http.StatusNotModified,
+		},
+		{
+			name:        "error",
+			compression: "gzip",
+			code:        http.StatusNotFound,
+			body:        large,
+			want:        tunnel.CompressionGzip,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if v := r.Header.Get(tunnel.CompressionHeader); v != "" {
+					t.Errorf("got %s %q passed upstream, want it removed", tunnel.CompressionHeader, v)
+				}
+				if tt.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				if tt.contentEncoding != "" {
+					w.Header().Set("Content-Encoding", tt.contentEncoding)
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			if tt.compression != "" {
+				r.Header.Set(tunnel.CompressionHeader, tt.compression)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("got status %d, want %d", w.Code, tt.code)
+			}
+			algorithm := w.Header().Get(tunnel.ContentEncodingHeader)
+			if algorithm != tt.want {
+				t.Fatalf("got %s %q, want %q", tunnel.ContentEncodingHeader, algorithm, tt.want)
+			}
+			body := w.Body.Bytes()
+			if algorithm != "" {
+				if w.Header().Get("Content-Length") != "" {
+					t.Error("got Content-Length on a compressed response, want none")
+				}
+				reader, err := tunnel.NewReader(algorithm, w.Body)
+				if err != nil {
+					t.Fatalf("decompressing: %s", err)
+				}
+				if body, err = ioutil.ReadAll(reader); err != nil {
+					t.Fatalf("decompressing: %s", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("got body of %d bytes, want %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
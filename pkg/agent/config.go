@@ -0,0 +1,75 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"time"
+
+	"github.com/namsral/flag"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+type Config struct {
+	ConnectURL         string
+	Transport          string
+	RawWebSocket       bool
+	CAFile             string
+	ServerName         string
+	InsecureSkipVerify bool
+	HubsFile           string
+	Sessions           int
+	HealthBindAddr     string
+	PolicyFile         string
+	PolicyRequired     bool
+	PolicyInterval     time.Duration
+	APIServerAddr      string
+	Namespace          string
+	Deployment         string
+
+	Session tunnel.SessionConfig
+}
+
+var C = Config{
+	Transport:      tunnel.TransportWebSocket,
+	Sessions:       1,
+	PolicyInterval: 30 * time.Second,
+	APIServerAddr:  "kubernetes.default",
+	Namespace:      "kopilot-system",
+	Deployment:     "kopilot-agent",
+
+	Session: tunnel.DefaultSessionConfig(),
+}
+
+func InitFlags(flag *flag.FlagSet) {
+	flag.StringVar(&C.ConnectURL, "connect", C.ConnectURL, "connect URL of kopilot-hub")
+	flag.StringVar(&C.Transport, "transport", C.Transport, "transport to kopilot-hub: websocket, http2 or tls")
+	flag.BoolVar(&C.RawWebSocket, "raw-websocket", C.RawWebSocket, "carry the session on the underlying connection of the WebSocket instead of in WebSocket messages, which intermediaries parsing WebSocket frames break")
+	flag.StringVar(&C.CAFile, "ca-file", C.CAFile, "CA certificates to verify kopilot-hub with instead of the system roots")
+	flag.StringVar(&C.ServerName, "server-name", C.ServerName, "server name to verify the certificate of kopilot-hub with instead of the host of the connect URL")
+	flag.BoolVar(&C.InsecureSkipVerify, "insecure-skip-verify", C.InsecureSkipVerify, "do not verify the certificate of kopilot-hub, which exposes the connect token to whoever answers")
+	flag.StringVar(&C.HubsFile, "hubs-file", C.HubsFile, "YAML file listing further hubs to hold sessions to at the same time, each with its name, connect URL, transport, raw-websocket, sessions and TLS settings")
+	flag.IntVar(&C.Sessions, "sessions", C.Sessions, "number of sessions to each hub, spread across distinct hub pods where possible")
+	flag.StringVar(&C.PolicyFile, "policy-file", C.PolicyFile, "YAML file with the policy of what hubs may do in the member cluster, reloaded when it changes; everything is allowed while it does not exist unless policy-required is set")
+	flag.BoolVar(&C.PolicyRequired, "policy-required", C.PolicyRequired, "deny everything while the policy file does not exist, instead of allowing everything")
+	flag.DurationVar(&C.PolicyInterval, "policy-reload-interval", C.PolicyInterval, "interval at which the policy file is checked for changes")
+	flag.StringVar(&C.HealthBindAddr, "health-bind", C.HealthBindAddr, "bind address of the health server reporting the sessions to hubs on /healthz, empty to disable")
+	flag.StringVar(&C.APIServerAddr, "apiserver", C.APIServerAddr, "kube-apiserver address")
+	flag.StringVar(&C.Namespace, "namespace", C.Namespace, "namespace of the kopilot-agent Deployment")
+	flag.StringVar(&C.Deployment, "deployment", C.Deployment, "name of the kopilot-agent Deployment, which is upgraded on request of kopilot-hub")
+	tunnel.InitSessionFlags(flag, &C.Session)
+}
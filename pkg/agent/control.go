@@ -0,0 +1,161 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+const agentContainerName = "kopilot-agent"
+
+// NewControlHandler serves the control API of the agent, which the hub
+// reaches by setting tunnel.TargetHeader to tunnel.TargetControl. Services,
+// endpoints and host services are set for the hub whose session carried the
+// request.
+func NewControlHandler(kubeClient kubernetes.Interface, policyEnforcer *PolicyEnforcer, serviceProxy *ServiceProxy, endpointForwarder *EndpointForwarder, hostServiceForwarder *HostServiceForwarder) http.Handler {
+	r := mux.NewRouter()
+	r.Path(tunnel.AgentStatusPath).Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deployment, err := kubeClient.AppsV1().Deployments(C.Namespace).Get(r.Context(), C.Deployment, metav1.GetOptions{})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get deployment: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deploymentStatus(deployment))
+	})
+	r.Path(tunnel.AgentImagePath).Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tunnel.AgentImage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+		if req.Image == "" {
+			http.Error(w, "image is required", http.StatusBadRequest)
+			return
+		}
+		if !policyEnforcer.AllowsImage(req.Image) {
+			log.Printf("rejecting agent image %q as not allowed by policy", req.Image)
+			http.Error(w, fmt.Sprintf("image %q is not allowed by the policy of kopilot-agent", req.Image), http.StatusForbidden)
+			return
+		}
+
+		deployment, err := setImage(r.Context(), kubeClient, req.Image)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to set image: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("rolling out agent image %q as requested by hub", req.Image)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deploymentStatus(deployment))
+	})
+	r.Path(tunnel.AgentServicesPath).Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var services []tunnel.Service
+		if err := json.NewDecoder(r.Body).Decode(&services); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := serviceProxy.SetServices(HubFromContext(r.Context()), services); err != nil {
+			http.Error(w, fmt.Sprintf("failed to set services: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(services)
+	})
+	r.Path(tunnel.AgentEndpointsPath).Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var endpoints []tunnel.Endpoint
+		if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := endpointForwarder.SetEndpoints(HubFromContext(r.Context()), endpoints); err != nil {
+			http.Error(w, fmt.Sprintf("failed to set endpoints: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpoints)
+	})
+	r.Path(tunnel.AgentHostServicesPath).Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var services []tunnel.HostService
+		if err := json.NewDecoder(r.Body).Decode(&services); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := hostServiceForwarder.SetHostServices(r.Context(), HubFromContext(r.Context()), services); err != nil {
+			http.Error(w, fmt.Sprintf("failed to set host services: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(services)
+	})
+	return r
+}
+
+func setImage(ctx context.Context, kubeClient kubernetes.Interface, image string) (*appsv1.Deployment, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{{
+						"name":  agentContainerName,
+						"image": image,
+					}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kubeClient.AppsV1().Deployments(C.Namespace).Patch(ctx, C.Deployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+}
+
+func deploymentStatus(deployment *appsv1.Deployment) *tunnel.AgentStatus {
+	status := &tunnel.AgentStatus{
+		Replicas:        deployment.Status.Replicas,
+		UpdatedReplicas: deployment.Status.UpdatedReplicas,
+		ReadyReplicas:   deployment.Status.ReadyReplicas,
+	}
+	if deployment.Spec.Replicas != nil {
+		status.Replicas = *deployment.Spec.Replicas
+	}
+	for _, c := range deployment.Spec.Template.Spec.Containers {
+		if c.Name == agentContainerName {
+			status.Image = c.Image
+		}
+	}
+	return status
+}
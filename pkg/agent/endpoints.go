@@ -0,0 +1,84 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// EndpointForwarder forwards TCP connections to the endpoints of the member
+// cluster each hub exposes and the policy allows. Connections from a hub to
+// any endpoint it did not expose are refused.
+type EndpointForwarder struct {
+	policyEnforcer *PolicyEnforcer
+	// addrs by hub name and endpoint name
+	addrs map[string]map[string]string
+	mutex sync.RWMutex
+}
+
+func NewEndpointForwarder(policyEnforcer *PolicyEnforcer) *EndpointForwarder {
+	return &EndpointForwarder{
+		policyEnforcer: policyEnforcer,
+		addrs:          map[string]map[string]string{},
+	}
+}
+
+// SetEndpoints replaces the endpoints hub may forward to. Endpoints the policy
+// does not allow are left out and reported in the error.
+func (f *EndpointForwarder) SetEndpoints(hub string, endpoints []tunnel.Endpoint) error {
+	var errs []error
+	addrs := map[string]string{}
+	for _, endpoint := range endpoints {
+		if !f.policyEnforcer.AllowsEndpoint(endpoint.Address) {
+			errs = append(errs, fmt.Errorf("endpoint %q: address %q is not allowed by the policy of kopilot-agent", endpoint.Name, endpoint.Address))
+			continue
+		}
+		addrs[endpoint.Name] = endpoint.Address
+	}
+
+	f.mutex.Lock()
+	f.addrs[hub] = addrs
+	f.mutex.Unlock()
+	log.Printf("exposing %d endpoint(s) of member cluster to hub %q", len(addrs), hub)
+	return utilerrors.NewAggregate(errs)
+}
+
+// ServeEndpoint upgrades r from hub to a raw TCP connection to the endpoint
+// named name.
+func (f *EndpointForwarder) ServeEndpoint(w http.ResponseWriter, r *http.Request, hub string, name string) {
+	f.mutex.RLock()
+	addr, ok := f.addrs[hub][name]
+	f.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("endpoint %q is not exposed", name), http.StatusNotFound)
+		return
+	}
+	// the policy may have changed since the endpoint was exposed
+	if !f.policyEnforcer.AllowsEndpoint(addr) {
+		http.Error(w, fmt.Sprintf("endpoint %q is not allowed by the policy of kopilot-agent", name), http.StatusForbidden)
+		return
+	}
+
+	tunnel.UpgradeToTCP(w, r, addr)
+}
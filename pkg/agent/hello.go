@@ -0,0 +1,50 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+	"github.com/smartxworks/kopilot/pkg/version"
+)
+
+// NewHello describes this agent and its member cluster for the handshake.
+// The member cluster is identified by the UID of its kube-system namespace.
+func NewHello(ctx context.Context, kubeClient kubernetes.Interface) (*tunnel.AgentHello, error) {
+	ns, err := kubeClient.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get namespace %q: %s", metav1.NamespaceSystem, err)
+	}
+
+	serverVersion, err := kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("get apiserver version: %s", err)
+	}
+
+	return &tunnel.AgentHello{
+		Version:           version.Version,
+		ProtocolVersion:   tunnel.ProtocolVersion,
+		Features:          tunnel.Features,
+		ClusterUID:        string(ns.UID),
+		KubernetesVersion: serverVersion.GitVersion,
+	}, nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// HostServiceForwarder listens on the ports of the host services each hub
+// exposes and forwards connections to the hub, which dials the host service.
+// The ports of all hubs are published by a Service named after the agent
+// Deployment. A host service whose name or port is taken by another hub, or
+// whose port the policy does not allow, is not exposed.
+type HostServiceForwarder struct {
+	kubeClient     kubernetes.Interface
+	policyEnforcer *PolicyEnforcer
+	dial           func(hub string) (net.Conn, error)
+	listeners      map[string]*hostServiceListener
+	mutex          sync.Mutex
+}
+
+type hostServiceListener struct {
+	hub      string
+	service  tunnel.HostService
+	listener net.Listener
+}
+
+// NewHostServiceForwarder returns a forwarder opening streams to the hub
+// named hub with dial.
+func NewHostServiceForwarder(kubeClient kubernetes.Interface, policyEnforcer *PolicyEnforcer, dial func(hub string) (net.Conn, error)) *HostServiceForwarder {
+	return &HostServiceForwarder{
+		kubeClient:     kubeClient,
+		policyEnforcer: policyEnforcer,
+		dial:           dial,
+		listeners:      map[string]*hostServiceListener{},
+	}
+}
+
+// SetHostServices replaces the host services of hub connections are
+// forwarded to.
+func (f *HostServiceForwarder) SetHostServices(ctx context.Context, hub string, services []tunnel.HostService) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var errs []error
+	var allowed []tunnel.HostService
+	for _, service := range services {
+		if !f.policyEnforcer.AllowsHostService(service.Port) {
+			errs = append(errs, fmt.Errorf("port %d of host service %q is not allowed by the policy of kopilot-agent", service.Port, service.Name))
+			continue
+		}
+		allowed = append(allowed, service)
+	}
+	services = allowed
+
+	wanted := map[string]tunnel.HostService{}
+	for _, service := range services {
+		wanted[service.Name] = service
+	}
+	for name, l := range f.listeners {
+		if l.hub != hub {
+			continue
+		}
+		if service, ok := wanted[name]; !ok || service != l.service {
+			l.listener.Close()
+			delete(f.listeners, name)
+		}
+	}
+
+	for _, service := range services {
+		if l, ok := f.listeners[service.Name]; ok {
+			if l.hub != hub {
+				errs = append(errs, fmt.Errorf("host service %q is exposed by hub %q", service.Name, l.hub))
+			}
+			continue
+		}
+		if other := f.listenerOnPort(service.Port); other != nil {
+			errs = append(errs, fmt.Errorf("port %d of host service %q is taken by host service %q of hub %q", service.Port, service.Name, other.service.Name, other.hub))
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(service.Port))))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen for host service %q: %s", service.Name, err))
+			continue
+		}
+		l := &hostServiceListener{
+			hub:      hub,
+			service:  service,
+			listener: listener,
+		}
+		f.listeners[service.Name] = l
+		go f.serve(l)
+	}
+	log.Printf("exposing %d host service(s) of hub %q to member cluster, %d in total", len(services), hub, len(f.listeners))
+
+	if err := f.syncService(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (f *HostServiceForwarder) listenerOnPort(port int32) *hostServiceListener {
+	for _, l := range f.listeners {
+		if l.service.Port == port {
+			return l
+		}
+	}
+	return nil
+}
+
+func (f *HostServiceForwarder) serve(l *hostServiceListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		// the policy may have changed since the host service was exposed
+		if !f.policyEnforcer.AllowsHostService(l.service.Port) {
+			log.Printf("refusing connection to host service %q as not allowed by policy", l.service.Name)
+			conn.Close()
+			continue
+		}
+		go f.forward(conn, l.hub, l.service.Name)
+	}
+}
+
+func (f *HostServiceForwarder) forward(conn net.Conn, hub string, name string) {
+	defer conn.Close()
+
+	stream, err := f.dial(hub)
+	if err != nil {
+		log.Printf("failed to dial hub %q for host service %q: %s", hub, name, err)
+		return
+	}
+	hubConn, err := tunnel.DialTCPUpgrade(stream, tunnel.HostServiceTarget(name))
+	if err != nil {
+		stream.Close()
+		log.Printf("failed to connect to host service %q: %s", name, err)
+		return
+	}
+	tunnel.Pipe(conn, hubConn)
+}
+
+// syncService publishes the ports of all listeners on the Service named after
+// the agent Deployment, which is deleted if there are none. The Service is
+// left alone if it already publishes them.
+func (f *HostServiceForwarder) syncService(ctx context.Context) error {
+	client := f.kubeClient.CoreV1().Services(C.Namespace)
+	if len(f.listeners) == 0 {
+		if err := client.Delete(ctx, C.Deployment, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete service: %s", err)
+		}
+		return nil
+	}
+
+	deployment, err := f.kubeClient.AppsV1().Deployments(C.Namespace).Get(ctx, C.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get deployment: %s", err)
+	}
+
+	var ports []corev1.ServicePort
+	for _, l := range f.listeners {
+		ports = append(ports, corev1.ServicePort{
+			Name:       l.service.Name,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       l.service.Port,
+			TargetPort: intstr.FromInt(int(l.service.Port)),
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+
+	service, err := client.Get(ctx, C.Deployment, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: C.Namespace,
+				Name:      C.Deployment,
+			},
+			Spec: corev1.ServiceSpec{
+				Selector: deployment.Spec.Selector.MatchLabels,
+				Ports:    ports,
+			},
+		}
+		if _, err := client.Create(ctx, service, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("create service: %s", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get service: %s", err)
+	}
+
+	if reflect.DeepEqual(service.Spec.Selector, deployment.Spec.Selector.MatchLabels) && reflect.DeepEqual(service.Spec.Ports, ports) {
+		return nil
+	}
+	service.Spec.Selector = deployment.Spec.Selector.MatchLabels
+	service.Spec.Ports = ports
+	if _, err := client.Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update service: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,492 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"sigs.k8s.io/yaml"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+	"github.com/smartxworks/kopilot/pkg/version"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+	// maxSpreadAttempts is how many times in a row a session is reconnected
+	// because it landed on a hub pod which already holds another session,
+	// before it is kept there.
+	maxSpreadAttempts = 5
+	// spreadBackoff is the delay before the first of those reconnects, which
+	// grows with each attempt and is jittered, so that sessions landing on the
+	// same pod do not keep following each other around.
+	spreadBackoff = 200 * time.Millisecond
+)
+
+var errSameHubPod = errors.New("landed on a hub pod which holds another session")
+
+// Hub is a kopilot-hub the agent holds a session to.
+type Hub struct {
+	// Name identifies the hub in logs and health reports. It defaults to the
+	// host of ConnectURL.
+	Name string `json:"name,omitempty"`
+	// ConnectURL is the connect URL of the hub, carrying the token of the
+	// Cluster which represents the member cluster there.
+	ConnectURL   string `json:"connect"`
+	Transport    string `json:"transport,omitempty"`
+	RawWebSocket bool   `json:"rawWebSocket,omitempty"`
+	// Sessions is the number of sessions to the hub, spread across its pods.
+	// It defaults to the sessions flag.
+	Sessions int `json:"sessions,omitempty"`
+	// CAData and the certificates in CAFile are trusted to verify the hub.
+	// Without either, the system roots are.
+	CAData []byte `json:"caData,omitempty"`
+	CAFile string `json:"caFile,omitempty"`
+	// ServerName verifies the certificate of the hub instead of the host of
+	// ConnectURL.
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// tlsConfig returns the TLS config verifying the hub.
+func (hub *Hub) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         hub.ServerName,
+		InsecureSkipVerify: hub.InsecureSkipVerify,
+	}
+	caData := hub.CAData
+	if hub.CAFile != "" {
+		data, err := os.ReadFile(hub.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %s", err)
+		}
+		caData = append(append([]byte{}, caData...), data...)
+	}
+	if len(caData) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no CA certificate found in CA data")
+		}
+	}
+	return config, nil
+}
+
+// Hubs returns the hub given by the connect and transport flags, followed by
+// the hubs listed in HubsFile. A missing HubsFile lists no hubs.
+func Hubs() ([]Hub, error) {
+	var hubs []Hub
+	if C.ConnectURL != "" {
+		hubs = append(hubs, Hub{
+			ConnectURL:         C.ConnectURL,
+			Transport:          C.Transport,
+			RawWebSocket:       C.RawWebSocket,
+			Sessions:           C.Sessions,
+			CAFile:             C.CAFile,
+			ServerName:         C.ServerName,
+			InsecureSkipVerify: C.InsecureSkipVerify,
+		})
+	}
+
+	if C.HubsFile != "" {
+		data, err := os.ReadFile(C.HubsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read hubs file: %s", err)
+		}
+		var listed []Hub
+		if err := yaml.UnmarshalStrict(data, &listed); err != nil {
+			return nil, fmt.Errorf("parse hubs file: %s", err)
+		}
+		hubs = append(hubs, listed...)
+	}
+
+	names := map[string]bool{}
+	for i := range hubs {
+		hub := &hubs[i]
+		u, err := url.Parse(hub.ConnectURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse connect URL of hub #%d: %s", i, err)
+		}
+		if hub.Name == "" {
+			hub.Name = u.Host
+		}
+		if hub.Transport == "" {
+			hub.Transport = tunnel.TransportWebSocket
+		}
+		if hub.Sessions == 0 {
+			hub.Sessions = C.Sessions
+		}
+		if hub.Sessions < 1 {
+			return nil, fmt.Errorf("invalid number of sessions %d to hub %q", hub.Sessions, hub.Name)
+		}
+		if names[hub.Name] {
+			return nil, fmt.Errorf("duplicate hub %q", hub.Name)
+		}
+		names[hub.Name] = true
+	}
+	if len(hubs) == 0 {
+		return nil, fmt.Errorf("no hub to connect to")
+	}
+	return hubs, nil
+}
+
+// HubStatus reports the health of a session to a hub.
+type HubStatus struct {
+	Name      string    `json:"name"`
+	Session   int       `json:"session"`
+	Connected bool      `json:"connected"`
+	HubID     string    `json:"hubID,omitempty"`
+	Since     time.Time `json:"since"`
+	Failures  int       `json:"failures,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HubSessions holds sessions to each of a list of hubs at the same time.
+// Sessions are tracked and reconnected independently, so any hub can serve
+// requests to the member cluster while the others are down. Sessions to the
+// same hub are spread across its pods by the hub ID returned in the
+// handshake, so that most pods serve requests on a session of their own
+// instead of forwarding them to peers.
+type HubSessions struct {
+	hello   *tunnel.AgentHello
+	server  *http.Server
+	onHello func(hub Hub, hubHello *tunnel.HubHello)
+	links   []*hubLink
+	// mutex serializes the claims of hub pods by sessions.
+	mutex sync.Mutex
+}
+
+// hubLink is one of the sessions to a hub.
+type hubLink struct {
+	hub       Hub
+	session   int
+	transport tunnel.Transport
+	tlsConfig *tls.Config
+
+	mutex             sync.RWMutex
+	sess              *yamux.Session
+	streamOpenTimeout time.Duration
+	status            HubStatus
+}
+
+// NewHubSessions returns sessions to hubs which say hello and are served by
+// server, whose requests tell HubFromContext which hub sent them. onHello is
+// called with the reply of a hub each time its session is established.
+func NewHubSessions(hubs []Hub, hello *tunnel.AgentHello, server *http.Server, onHello func(hub Hub, hubHello *tunnel.HubHello)) (*HubSessions, error) {
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if conn, ok := c.(*hubConn); ok {
+			return context.WithValue(ctx, hubContextKey{}, conn.hub)
+		}
+		return ctx
+	}
+	s := &HubSessions{
+		hello:   hello,
+		server:  server,
+		onHello: onHello,
+	}
+	for _, hub := range hubs {
+		transport, err := tunnel.GetTransport(hub.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("get transport of hub %q: %s", hub.Name, err)
+		}
+		if hub.Transport == tunnel.TransportWebSocket && hub.RawWebSocket {
+			transport = tunnel.WebSocketTransport{Raw: true}
+		}
+		tlsConfig, err := hub.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("get TLS config of hub %q: %s", hub.Name, err)
+		}
+		if hub.InsecureSkipVerify {
+			log.Printf("not verifying the certificate of hub %q", hub.Name)
+		}
+		for i := 0; i < hub.Sessions; i++ {
+			s.links = append(s.links, &hubLink{
+				hub:       hub,
+				session:   i,
+				transport: transport,
+				tlsConfig: tlsConfig,
+				status: HubStatus{
+					Name:    hub.Name,
+					Session: i,
+					Since:   time.Now(),
+				},
+			})
+		}
+	}
+	return s, nil
+}
+
+// Run connects all sessions to their hubs and keeps reconnecting them until
+// ctx is done.
+func (s *HubSessions) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, l := range s.links {
+		wg.Add(1)
+		go func(l *hubLink) {
+			defer wg.Done()
+			s.run(ctx, l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+func (s *HubSessions) run(ctx context.Context, l *hubLink) {
+	backoff := minReconnectBackoff
+	spreadAttempts := 0
+	for {
+		connected, err := s.connect(ctx, l, spreadAttempts < maxSpreadAttempts)
+		if ctx.Err() != nil || err == http.ErrServerClosed {
+			return
+		}
+		if err == errSameHubPod {
+			spreadAttempts++
+			delay := time.Duration(spreadAttempts)*spreadBackoff + time.Duration(rand.Int63n(int64(spreadBackoff)))
+			log.Printf("session #%d to hub %q %s, reconnecting in %s", l.session, l.hub.Name, err, delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		spreadAttempts = 0
+
+		l.setDisconnected(err)
+		if connected {
+			backoff = minReconnectBackoff
+			log.Printf("lost session #%d to hub %q: %s, reconnecting in %s", l.session, l.hub.Name, err, backoff)
+		} else {
+			log.Printf("failed to connect session #%d to hub %q: %s, retrying in %s", l.session, l.hub.Name, err, backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// connect establishes the session of l and serves it until it is closed. It
+// reports whether the session was established. If spread is true, sessions
+// landing on a hub pod which holds another session of the same hub are
+// closed with errSameHubPod.
+func (s *HubSessions) connect(ctx context.Context, l *hubLink, spread bool) (bool, error) {
+	header := http.Header{}
+	header.Set(tunnel.ProtocolVersionHeader, strconv.Itoa(tunnel.ProtocolVersion))
+	header.Set(tunnel.AgentVersionHeader, version.Version)
+	conn, responseHeader, err := l.transport.Dial(ctx, l.hub.ConnectURL, header, l.tlsConfig)
+	if err != nil {
+		return false, fmt.Errorf("dial over %s: %s", l.hub.Transport, err)
+	}
+
+	overrides, err := tunnel.ParseSessionConfig(responseHeader.Get(tunnel.SessionConfigHeader))
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("parse session config: %s", err)
+	}
+	sessionConfig := C.Session.Merge(overrides)
+	yamuxConfig, err := sessionConfig.YamuxConfig()
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("invalid session config: %s", err)
+	}
+
+	sess, err := yamux.Client(conn, yamuxConfig)
+	if err != nil {
+		conn.Close()
+		return false, fmt.Errorf("create multiplex channel: %s", err)
+	}
+	defer sess.Close()
+	log.Printf("session #%d to hub %q uses %s", l.session, l.hub.Name, sessionConfig)
+
+	hubHello, err := tunnel.Handshake(sess, s.hello)
+	if err != nil {
+		return false, fmt.Errorf("handshake: %s", err)
+	}
+	if !s.claim(l, hubHello.HubID, spread, sess, sessionConfig.StreamOpenTimeout) {
+		return false, errSameHubPod
+	}
+	log.Printf("connected session #%d to hub %q: %s (%s) with protocol version %d and features %v", l.session, l.hub.Name, hubHello.HubID, hubHello.Version, hubHello.ProtocolVersion, hubHello.Features)
+
+	s.onHello(l.hub, hubHello)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-stop:
+		}
+	}()
+	return true, s.server.Serve(&hubListener{Listener: sess, hub: l.hub.Name})
+}
+
+type hubContextKey struct{}
+
+// HubFromContext returns the name of the hub whose session carried the
+// request of ctx.
+func HubFromContext(ctx context.Context) string {
+	hub, _ := ctx.Value(hubContextKey{}).(string)
+	return hub
+}
+
+// hubListener accepts the streams of a session to hub.
+type hubListener struct {
+	net.Listener
+	hub string
+}
+
+func (l *hubListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &hubConn{Conn: conn, hub: l.hub}, nil
+}
+
+// hubConn is a stream of a session to hub.
+type hubConn struct {
+	net.Conn
+	hub string
+}
+
+// claim marks l connected to the hub pod hubID. If spread is true, it fails
+// when another session to the same hub is connected to that pod.
+func (s *HubSessions) claim(l *hubLink, hubID string, spread bool, sess *yamux.Session, streamOpenTimeout time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if spread {
+		for _, other := range s.links {
+			if other == l || other.hub.Name != l.hub.Name {
+				continue
+			}
+			other.mutex.RLock()
+			taken := other.status.Connected && other.status.HubID == hubID
+			other.mutex.RUnlock()
+			if taken {
+				return false
+			}
+		}
+	}
+	l.setConnected(sess, streamOpenTimeout, hubID)
+	return true
+}
+
+func (l *hubLink) setConnected(sess *yamux.Session, streamOpenTimeout time.Duration, hubID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sess = sess
+	l.streamOpenTimeout = streamOpenTimeout
+	l.status = HubStatus{
+		Name:      l.hub.Name,
+		Session:   l.session,
+		Connected: true,
+		HubID:     hubID,
+		Since:     time.Now(),
+	}
+}
+
+func (l *hubLink) setDisconnected(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.status.Connected {
+		l.status = HubStatus{
+			Name:    l.hub.Name,
+			Session: l.session,
+			Since:   time.Now(),
+		}
+	}
+	l.sess = nil
+	l.status.Failures++
+	l.status.Error = err.Error()
+}
+
+// DialHub opens a stream to the hub named hub, on a random one of its
+// established sessions.
+func (s *HubSessions) DialHub(hub string) (net.Conn, error) {
+	var links []*hubLink
+	for _, l := range s.links {
+		if l.hub.Name == hub {
+			links = append(links, l)
+		}
+	}
+	for _, i := range rand.Perm(len(links)) {
+		l := links[i]
+		l.mutex.RLock()
+		sess, timeout := l.sess, l.streamOpenTimeout
+		l.mutex.RUnlock()
+		if sess == nil {
+			continue
+		}
+		stream, err := tunnel.OpenStream(sess, timeout)
+		if err != nil {
+			log.Printf("failed to open stream on session #%d to hub %q: %s", l.session, l.hub.Name, err)
+			continue
+		}
+		return stream, nil
+	}
+	return nil, fmt.Errorf("no session to hub %q", hub)
+}
+
+// Status returns the health of all sessions to all hubs.
+func (s *HubSessions) Status() []HubStatus {
+	var statuses []HubStatus
+	for _, l := range s.links {
+		l.mutex.RLock()
+		statuses = append(statuses, l.status)
+		l.mutex.RUnlock()
+	}
+	return statuses
+}
+
+// ServeHTTP reports the health of all sessions to all hubs. It answers 200
+// if at least one session is established, and 503 otherwise.
+func (s *HubSessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := s.Status()
+	code := http.StatusServiceUnavailable
+	for _, status := range statuses {
+		if status.Connected {
+			code = http.StatusOK
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf("failed to write hub statuses: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+func TestHubs(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectURL string
+		hubsFile   string
+		want       []Hub
+		wantErr    bool
+	}{
+		{
+			name:       "connect flag only",
+			connectURL: "wss://hub.example.com/connect?token=a",
+			want: []Hub{
+				{Name: "hub.example.com", ConnectURL: "wss://hub.example.com/connect?token=a", Transport: tunnel.TransportWebSocket, Sessions: 1},
+			},
+		},
+		{
+			name:       "listed hubs after the connect flag",
+			connectURL: "wss://hub.example.com/connect?token=a",
+			hubsFile: `
+- name: standby
+  connect: https://standby.example.com/connect?token=b
+  transport: http2
+  sessions: 2
+  serverName: hub.internal
+- connect: wss://other.example.com/connect?token=c
+`,
+			want: []Hub{
+				{Name: "hub.example.com", ConnectURL: "wss://hub.example.com/connect?token=a", Transport: tunnel.TransportWebSocket, Sessions: 1},
+				{Name: "standby", ConnectURL: "https://standby.example.com/connect?token=b", Transport: tunnel.TransportHTTP2, Sessions: 2, ServerName: "hub.internal"},
+				{Name: "other.example.com", ConnectURL: "wss://other.example.com/connect?token=c", Transport: tunnel.TransportWebSocket, Sessions: 1},
+			},
+		},
+		{
+			name:     "listed hubs only",
+			hubsFile: "- connect: wss://hub.example.com/connect?token=a\n",
+			want: []Hub{
+				{Name: "hub.example.com", ConnectURL: "wss://hub.example.com/connect?token=a", Transport: tunnel.TransportWebSocket, Sessions: 1},
+			},
+		},
+		{
+			name:    "no hub",
+			wantErr: true,
+		},
+		{
+			name:       "unknown field",
+			connectURL: "wss://hub.example.com/connect?token=a",
+			hubsFile:   "- connect: wss://standby.example.com/connect?token=b\n  server: standby\n",
+			wantErr:    true,
+		},
+		{
+			name:       "not a list",
+			connectURL: "wss://hub.example.com/connect?token=a",
+			hubsFile:   "connect: wss://standby.example.com/connect?token=b\n",
+			wantErr:    true,
+		},
+		{
+			name:       "duplicate name",
+			connectURL: "wss://hub.example.com/connect?token=a",
+			hubsFile:   "- connect: wss://hub.example.com/connect?token=b\n",
+			wantErr:    true,
+		},
+		{
+			name:     "invalid sessions",
+			hubsFile: "- connect: wss://hub.example.com/connect?token=a\n  sessions: -1\n",
+			wantErr:  true,
+		},
+	}
+	defer func(c Config) {
+		C = c
+	}(C)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			C.ConnectURL = tt.connectURL
+			C.Transport = tunnel.TransportWebSocket
+			C.Sessions = 1
+			// a missing hubs file lists no hubs
+			C.HubsFile = filepath.Join(t.TempDir(), "hubs.yaml")
+			if tt.hubsFile != "" {
+				if err := ioutil.WriteFile(C.HubsFile, []byte(tt.hubsFile), 0644); err != nil {
+					t.Fatalf("writing hubs file: %s", err)
+				}
+			}
+
+			hubs, err := Hubs()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got hubs %+v, want an error", hubs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+			if !reflect.DeepEqual(hubs, tt.want) {
+				t.Errorf("got hubs %+v, want %+v", hubs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/smartxworks/kopilot/pkg/policy"
+)
+
+// Policy lists what hubs may do in the member cluster through the agent.
+type Policy struct {
+	// Rules allow requests to the apiserver of the member cluster. Requests
+	// no rule allows are rejected before they reach the apiserver.
+	Rules []policy.Rule `json:"rules,omitempty"`
+	// AgentImages allow hubs to roll the agent out to the images listed, where
+	// a trailing "*" matches any suffix. Self-upgrades to other images are
+	// rejected.
+	AgentImages []string `json:"agentImages,omitempty"`
+	// Services allow hubs to proxy to the service URLs listed, where a
+	// trailing "*" matches any suffix. Other services are not exposed.
+	Services []string `json:"services,omitempty"`
+	// Endpoints allow hubs to forward connections to the endpoint addresses
+	// listed, where a trailing "*" matches any suffix. Other endpoints are not
+	// exposed.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// HostServices allow hubs to expose host services on the ports listed.
+	// Host services on other ports are not exposed.
+	HostServices []int32 `json:"hostServices,omitempty"`
+}
+
+// AllowsImage reports whether the agent may be rolled out to image.
+func (p *Policy) AllowsImage(image string) bool {
+	return matchesAny(p.AgentImages, image)
+}
+
+// AllowsService reports whether hubs may proxy to the service at url.
+func (p *Policy) AllowsService(url string) bool {
+	return matchesAny(p.Services, url)
+}
+
+// AllowsEndpoint reports whether hubs may forward connections to the endpoint
+// at address.
+func (p *Policy) AllowsEndpoint(address string) bool {
+	return matchesAny(p.Endpoints, address)
+}
+
+// AllowsHostService reports whether hubs may expose a host service on port.
+func (p *Policy) AllowsHostService(port int32) bool {
+	for _, allowed := range p.HostServices {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if pattern == s || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyEnforcer enforces the Policy in a file, which is reloaded when it
+// changes. Without the file, everything is allowed, unless the policy is
+// required, in which case everything is denied.
+type PolicyEnforcer struct {
+	file     string
+	required bool
+	loaded   bool
+	data   []byte
+	policy *Policy
+	mutex  sync.RWMutex
+}
+
+// NewPolicyEnforcer returns an enforcer of the policy in file, which is loaded
+// right away. If required, everything is denied while file does not exist.
+func NewPolicyEnforcer(file string, required bool) (*PolicyEnforcer, error) {
+	e := &PolicyEnforcer{
+		file:     file,
+		required: required,
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *PolicyEnforcer) load() error {
+	if e.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(e.file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read policy file: %s", err)
+	}
+
+	e.mutex.RLock()
+	unchanged := e.loaded && (data == nil) == (e.data == nil) && bytes.Equal(data, e.data)
+	e.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var p *Policy
+	if data != nil {
+		p = &Policy{}
+		if err := yaml.UnmarshalStrict(data, p); err != nil {
+			return fmt.Errorf("parse policy file: %s", err)
+		}
+		for i := range p.Rules {
+			if err := p.Rules[i].Validate(); err != nil {
+				return fmt.Errorf("invalid rule #%d of policy: %s", i, err)
+			}
+		}
+		log.Printf("enforcing policy of %d rule(s), %d agent image(s), %d service(s), %d endpoint(s) and %d host service port(s) from %s", len(p.Rules), len(p.AgentImages), len(p.Services), len(p.Endpoints), len(p.HostServices), e.file)
+	} else if e.required {
+		p = &Policy{}
+		log.Printf("no policy found at %s, denying all requests as the policy is required", e.file)
+	} else {
+		log.Printf("no policy found at %s, allowing all requests", e.file)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.loaded = true
+	e.data = data
+	e.policy = p
+	return nil
+}
+
+// Run reloads the policy every interval until ctx is done. Invalid policies
+// are logged and leave the previous one in force.
+func (e *PolicyEnforcer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.load(); err != nil {
+				log.Printf("failed to reload policy: %s", err)
+			}
+		}
+	}
+}
+
+// Policy returns the policy in force, or nil if everything is allowed.
+func (e *PolicyEnforcer) Policy() *Policy {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.policy
+}
+
+// Enforce rejects requests to the apiserver the policy does not allow with a
+// Forbidden Status, and passes the others to h.
+func (e *PolicyEnforcer) Enforce(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := e.Policy(); p != nil {
+			if err := policy.ValidatePath(r.URL.Path); err != nil {
+				log.Printf("rejecting request: %s", err)
+				policy.WriteStatusError(w, apierrors.NewBadRequest(err.Error()))
+				return
+			}
+			attrs := policy.NewAttributes(r.Method, r.URL.Path, r.URL.Query())
+			if !policy.Allows(p.Rules, attrs) {
+				log.Printf("rejecting %s as not allowed by policy", attrs)
+				policy.WriteStatusError(w, policy.Forbidden(attrs, "not allowed by the policy of kopilot-agent"))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AllowsImage reports whether the agent may be rolled out to image.
+func (e *PolicyEnforcer) AllowsImage(image string) bool {
+	p := e.Policy()
+	return p == nil || p.AllowsImage(image)
+}
+
+// AllowsService reports whether hubs may proxy to the service at url.
+func (e *PolicyEnforcer) AllowsService(url string) bool {
+	p := e.Policy()
+	return p == nil || p.AllowsService(url)
+}
+
+// AllowsEndpoint reports whether hubs may forward connections to the endpoint
+// at address.
+func (e *PolicyEnforcer) AllowsEndpoint(address string) bool {
+	p := e.Policy()
+	return p == nil || p.AllowsEndpoint(address)
+}
+
+// AllowsHostService reports whether hubs may expose a host service on port.
+func (e *PolicyEnforcer) AllowsHostService(port int32) bool {
+	p := e.Policy()
+	return p == nil || p.AllowsHostService(port)
+}
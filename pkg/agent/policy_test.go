@@ -0,0 +1,239 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+  - verbs: ["get", "list"]
+    apiGroups: [""]
+    resources: ["pods"]
+    namespaces: ["default"]
+  - verbs: ["get"]
+    nonResourceURLs: ["/version"]
+agentImages: ["smartxworks/kopilot-agent:*"]
+services: ["http://prometheus.monitoring:9090", "https://grafana.monitoring:*"]
+endpoints: ["postgres.db.svc:5432"]
+hostServices: [3100]
+`
+
+// newTestPolicyEnforcer returns an enforcer of policy, or of a file which does
+// not exist if policy is empty.
+func newTestPolicyEnforcer(t *testing.T, policy string, required bool) *PolicyEnforcer {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if policy != "" {
+		if err := ioutil.WriteFile(file, []byte(policy), 0644); err != nil {
+			t.Fatalf("writing policy: %s", err)
+		}
+	}
+	e, err := NewPolicyEnforcer(file, required)
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+	return e
+}
+
+func TestPolicyEnforcerEnforce(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		required bool
+		method   string
+		path     string
+		want     int
+	}{
+		{
+			name:   "allowed by rule",
+			policy: testPolicy,
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "other namespace",
+			policy: testPolicy,
+			method: "GET",
+			path:   "/api/v1/namespaces/kube-system/pods",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "other verb",
+			policy: testPolicy,
+			method: "DELETE",
+			path:   "/api/v1/namespaces/default/pods/foo",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "non-resource URL",
+			policy: testPolicy,
+			method: "GET",
+			path:   "/version",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "path escaping an allowed namespace",
+			policy: testPolicy,
+			method: "GET",
+			path:   "/api/v1/namespaces/default/../kube-system/pods",
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "no policy",
+			method: "DELETE",
+			path:   "/api/v1/namespaces/kube-system/secrets/foo",
+			want:   http.StatusOK,
+		},
+		{
+			name:     "no policy when required",
+			required: true,
+			method:   "GET",
+			path:     "/version",
+			want:     http.StatusForbidden,
+		},
+		{
+			name:     "policy when required",
+			policy:   testPolicy,
+			required: true,
+			method:   "GET",
+			path:     "/version",
+			want:     http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestPolicyEnforcer(t, tt.policy, tt.required)
+			h := e.Enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyEnforcerAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		required    bool
+		image       string
+		service     string
+		endpoint    string
+		hostService int32
+		want        bool
+	}{
+		{
+			name:        "listed",
+			policy:      testPolicy,
+			image:       "smartxworks/kopilot-agent:v0.3.0",
+			service:     "https://grafana.monitoring:3000",
+			endpoint:    "postgres.db.svc:5432",
+			hostService: 3100,
+			want:        true,
+		},
+		{
+			name:        "not listed",
+			policy:      testPolicy,
+			image:       "example.com/kopilot-agent:v0.3.0",
+			service:     "http://prometheus.monitoring:9091",
+			endpoint:    "postgres.db.svc:5433",
+			hostService: 3101,
+		},
+		{
+			name:        "prefix of a pattern without a wildcard",
+			policy:      testPolicy,
+			image:       "smartxworks/kopilot-agent",
+			service:     "http://prometheus.monitoring:909",
+			endpoint:    "postgres.db.svc:543",
+			hostService: 310,
+		},
+		{
+			name:        "no policy",
+			image:       "example.com/kopilot-agent:v0.3.0",
+			service:     "http://prometheus.monitoring:9091",
+			endpoint:    "postgres.db.svc:5433",
+			hostService: 3101,
+			want:        true,
+		},
+		{
+			name:        "no policy when required",
+			required:    true,
+			image:       "smartxworks/kopilot-agent:v0.3.0",
+			service:     "https://grafana.monitoring:3000",
+			endpoint:    "postgres.db.svc:5432",
+			hostService: 3100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestPolicyEnforcer(t, tt.policy, tt.required)
+			if got := e.AllowsImage(tt.image); got != tt.want {
+				t.Errorf("AllowsImage(%q) = %t, want %t", tt.image, got, tt.want)
+			}
+			if got := e.AllowsService(tt.service); got != tt.want {
+				t.Errorf("AllowsService(%q) = %t, want %t", tt.service, got, tt.want)
+			}
+			if got := e.AllowsEndpoint(tt.endpoint); got != tt.want {
+				t.Errorf("AllowsEndpoint(%q) = %t, want %t", tt.endpoint, got, tt.want)
+			}
+			if got := e.AllowsHostService(tt.hostService); got != tt.want {
+				t.Errorf("AllowsHostService(%d) = %t, want %t", tt.hostService, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPolicyEnforcerInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{
+			name:   "not YAML",
+			policy: "rules: [",
+		},
+		{
+			name:   "unknown field",
+			policy: "rule: []",
+		},
+		{
+			name:   "rule without verbs",
+			policy: "rules: [{apiGroups: [\"\"], resources: [\"pods\"]}]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.policy), 0644); err != nil {
+				t.Fatalf("writing policy: %s", err)
+			}
+			if _, err := NewPolicyEnforcer(file, false); err == nil {
+				t.Error("got no error, want one")
+			}
+		})
+	}
+}
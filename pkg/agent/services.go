@@ -0,0 +1,151 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// ServiceProxy proxies requests to the services of the member cluster each
+// hub exposes and the policy allows. Requests from a hub to any service it did
+// not expose are refused.
+type ServiceProxy struct {
+	policyEnforcer *PolicyEnforcer
+	// proxies by hub name and service name
+	proxies map[string]map[string]*serviceProxy
+	mutex   sync.RWMutex
+}
+
+type serviceProxy struct {
+	service tunnel.Service
+	handler http.Handler
+}
+
+func NewServiceProxy(policyEnforcer *PolicyEnforcer) *ServiceProxy {
+	return &ServiceProxy{
+		policyEnforcer: policyEnforcer,
+		proxies:        map[string]map[string]*serviceProxy{},
+	}
+}
+
+// SetServices replaces the services hub may proxy to. Services the policy
+// does not allow are left out and reported in the error.
+func (p *ServiceProxy) SetServices(hub string, services []tunnel.Service) error {
+	var errs []error
+	proxies := map[string]*serviceProxy{}
+	p.mutex.RLock()
+	for _, service := range services {
+		if !p.policyEnforcer.AllowsService(service.URL) {
+			errs = append(errs, fmt.Errorf("service %q: URL %q is not allowed by the policy of kopilot-agent", service.Name, service.URL))
+			continue
+		}
+		if old, ok := p.proxies[hub][service.Name]; ok && reflect.DeepEqual(old.service, service) {
+			proxies[service.Name] = old
+			continue
+		}
+		handler, err := newServiceHandler(service)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %s", service.Name, err))
+			continue
+		}
+		proxies[service.Name] = &serviceProxy{
+			service: service,
+			handler: handler,
+		}
+	}
+	p.mutex.RUnlock()
+
+	p.mutex.Lock()
+	p.proxies[hub] = proxies
+	p.mutex.Unlock()
+	log.Printf("exposing %d service(s) of member cluster to hub %q", len(proxies), hub)
+	return utilerrors.NewAggregate(errs)
+}
+
+// ServeService proxies r from hub to the service named name.
+func (p *ServiceProxy) ServeService(w http.ResponseWriter, r *http.Request, hub string, name string) {
+	p.mutex.RLock()
+	proxy, ok := p.proxies[hub][name]
+	p.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("service %q is not exposed", name), http.StatusNotFound)
+		return
+	}
+	// the policy may have changed since the service was exposed
+	if !p.policyEnforcer.AllowsService(proxy.service.URL) {
+		http.Error(w, fmt.Sprintf("service %q is not allowed by the policy of kopilot-agent", name), http.StatusForbidden)
+		return
+	}
+	proxy.handler.ServeHTTP(w, r)
+}
+
+func newServiceHandler(service tunnel.Service) (http.Handler, error) {
+	target, err := url.Parse(service.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %s", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", target.Scheme)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         service.ServerName,
+		InsecureSkipVerify: service.InsecureSkipVerify,
+		// upgraded connections such as WebSocket require HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+	if len(service.CAData) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(service.CAData) {
+			return nil, fmt.Errorf("no CA certificate found in CA data")
+		}
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(target)
+	origDirector := rp.Director
+	rp.Director = func(r *http.Request) {
+		origDirector(r)
+		r.Host = target.Host
+		r.Header.Del(tunnel.TargetHeader)
+	}
+	rp.FlushInterval = -1
+	rp.Transport = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
+	}
+	return rp, nil
+}
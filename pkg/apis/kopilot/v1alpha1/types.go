@@ -17,17 +17,408 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:subresource:status
 
 type Cluster struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
 	Token string `json:"token,omitempty"`
+
+	Spec   ClusterSpec   `json:"spec,omitempty"`
+	Status ClusterStatus `json:"status,omitempty"`
+}
+
+type ClusterSpec struct {
+	// Suspended cuts off access to the member cluster without deleting the Cluster.
+	// While set, agents may not connect, existing sessions are closed and proxied
+	// requests are refused.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// Agent configures how the hub manages agents of the member cluster.
+	// +optional
+	Agent *ClusterAgentSpec `json:"agent,omitempty"`
+
+	// Limits on requests proxied to the member cluster by each hub replica.
+	// Unset fields fall back to the defaults of the hub.
+	// +optional
+	Limits *ClusterLimits `json:"limits,omitempty"`
+
+	// Services of the member cluster exposed through the services subresource,
+	// in addition to its apiserver. Agents refuse to proxy to anything else.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Services []ClusterService `json:"services,omitempty"`
+
+	// Endpoints of the member cluster whose TCP connections may be forwarded
+	// through the endpoints subresource. Agents refuse to forward to anything else.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Endpoints []ClusterEndpoint `json:"endpoints,omitempty"`
+
+	// HostServices of the host cluster which workloads of the member cluster
+	// may reach through the kopilot-agent Service in the member cluster.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	HostServices []ClusterHostService `json:"hostServices,omitempty"`
+
+	// Transport carrying the session between agents and hub. Agents installed
+	// from the agent subresource use it. Defaults to WebSocket.
+	// +optional
+	Transport ClusterTransport `json:"transport,omitempty"`
+
+	// Session overrides the yamux session config of hub and agents.
+	// Unset fields fall back to the flags of each side.
+	// +optional
+	Session *ClusterSession `json:"session,omitempty"`
+
+	// Compression of responses tunnelled from the member cluster.
+	// Defaults to the compression of the hub.
+	// +optional
+	Compression *ClusterCompression `json:"compression,omitempty"`
+
+	// Policy restricts requests proxied to the apiserver of the member cluster
+	// beyond RBAC on the proxy subresource. Without it, all requests are allowed.
+	// +optional
+	Policy *ClusterPolicy `json:"policy,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Auto;Manual;Pinned
+
+type AgentUpgradePolicy string
+
+const (
+	// AgentUpgradePolicyAuto upgrades agents to the agent image of the hub.
+	AgentUpgradePolicyAuto AgentUpgradePolicy = "Auto"
+	// AgentUpgradePolicyManual leaves agents on whatever image they run.
+	AgentUpgradePolicyManual AgentUpgradePolicy = "Manual"
+	// AgentUpgradePolicyPinned keeps agents on the image given in the Cluster.
+	AgentUpgradePolicyPinned AgentUpgradePolicy = "Pinned"
+)
+
+type ClusterAgentSpec struct {
+	// UpgradePolicy decides which image agents run: Auto follows the agent image
+	// of the hub, Pinned keeps agents on Image and Manual leaves agents alone.
+	// Defaults to Auto.
+	// +optional
+	UpgradePolicy AgentUpgradePolicy `json:"upgradePolicy,omitempty"`
+
+	// Image of agents under the Pinned upgrade policy.
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+type ClusterLimits struct {
+	// QPS is the sustained rate of short-running requests per second. 0 means unlimited.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	QPS *int32 `json:"qps,omitempty"`
+
+	// Burst is the number of short-running requests allowed above QPS in a short period.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Burst *int32 `json:"burst,omitempty"`
+
+	// MaxInflight is the maximum number of concurrent short-running requests. 0 means unlimited.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MaxInflight *int32 `json:"maxInflight,omitempty"`
+
+	// MaxInflightLongRunning is the maximum number of concurrent long-running requests,
+	// such as watch, exec, attach and port-forward. 0 means unlimited.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MaxInflightLongRunning *int32 `json:"maxInflightLongRunning,omitempty"`
+}
+
+type ClusterService struct {
+	// Name of the service in paths of the services subresource.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// URL of the service inside the member cluster, such as http://prometheus.monitoring:9090.
+	URL string `json:"url"`
+
+	// TLS configures how agents verify HTTPS services.
+	// +optional
+	TLS *ClusterServiceTLS `json:"tls,omitempty"`
+}
+
+type ClusterServiceTLS struct {
+	// CABundle is a PEM encoded bundle of CAs trusted to sign the certificate
+	// of the service. Defaults to the system roots of the agent.
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+
+	// ServerName is the name the certificate of the service is verified
+	// against. Defaults to the host of URL.
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// InsecureSkipVerify disables verification of the certificate of the service.
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+type ClusterEndpoint struct {
+	// Name of the endpoint in paths of the endpoints subresource.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Address of the endpoint inside the member cluster, such as postgres.db:5432.
+	Address string `json:"address"`
+}
+
+type ClusterHostService struct {
+	// Name of the port of the kopilot-agent Service in the member cluster.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Address of the service inside the host cluster, such as loki.logging:3100.
+	Address string `json:"address"`
+
+	// Port of the kopilot-agent Service in the member cluster which is forwarded to Address.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+}
+
+// +kubebuilder:validation:Enum=WebSocket;HTTP2;TLS
+
+type ClusterTransport string
+
+const (
+	// ClusterTransportWebSocket upgrades the connect request to WebSocket
+	// through kube-apiserver of the host cluster.
+	ClusterTransportWebSocket ClusterTransport = "WebSocket"
+	// ClusterTransportHTTP2 streams the session over an HTTP/2 CONNECT
+	// request to the public listener of the hub.
+	ClusterTransportHTTP2 ClusterTransport = "HTTP2"
+	// ClusterTransportTLS carries the session on a TLS connection to the
+	// public listener of the hub.
+	ClusterTransportTLS ClusterTransport = "TLS"
+)
+
+type ClusterSession struct {
+	// KeepAliveInterval is how often sessions are pinged.
+	// +optional
+	KeepAliveInterval *metav1.Duration `json:"keepAliveInterval,omitempty"`
+
+	// ConnectionWriteTimeout is how long a write to the connection carrying
+	// a session may take before the session is closed.
+	// +optional
+	ConnectionWriteTimeout *metav1.Duration `json:"connectionWriteTimeout,omitempty"`
+
+	// MaxStreamWindowSize is the receive window of each stream in bytes.
+	// Larger windows speed up streams on links with high latency.
+	// +optional
+	// +kubebuilder:validation:Minimum=262144
+	MaxStreamWindowSize *int32 `json:"maxStreamWindowSize,omitempty"`
+
+	// AcceptBacklog is the number of streams which may wait to be accepted.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	AcceptBacklog *int32 `json:"acceptBacklog,omitempty"`
+
+	// StreamOpenTimeout is how long opening a stream may wait for the backlog.
+	// +optional
+	StreamOpenTimeout *metav1.Duration `json:"streamOpenTimeout,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=None;Gzip;Deflate
+
+type CompressionAlgorithm string
+
+const (
+	CompressionAlgorithmNone    CompressionAlgorithm = "None"
+	CompressionAlgorithmGzip    CompressionAlgorithm = "Gzip"
+	CompressionAlgorithmDeflate CompressionAlgorithm = "Deflate"
+)
+
+type ClusterCompression struct {
+	// Algorithm responses are compressed with. None disables compression.
+	Algorithm CompressionAlgorithm `json:"algorithm"`
+
+	// Level from 1 (fastest) to 9 (smallest). Defaults to the level of the hub.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=9
+	Level *int32 `json:"level,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Allow;Deny
+
+type PolicyAction string
+
+const (
+	PolicyActionAllow PolicyAction = "Allow"
+	PolicyActionDeny  PolicyAction = "Deny"
+)
+
+type ClusterPolicy struct {
+	// Rules are evaluated in order, and the first rule matching a request
+	// decides whether it is allowed.
+	// +optional
+	Rules []ClusterPolicyRule `json:"rules,omitempty"`
+
+	// DefaultAction applies to requests no rule matches. Defaults to Allow.
+	// +optional
+	DefaultAction PolicyAction `json:"defaultAction,omitempty"`
+}
+
+type ClusterPolicyRule struct {
+	// Action taken on requests matching the rule.
+	Action PolicyAction `json:"action"`
+
+	// Users of the host cluster the rule applies to. The rule applies to
+	// everyone if both Users and Groups are empty.
+	// +optional
+	Users []string `json:"users,omitempty"`
+
+	// Groups of the host cluster the rule applies to.
+	// +optional
+	Groups []string `json:"groups,omitempty"`
+
+	// Verbs matched by the rule, such as get, list, watch or create. * matches all verbs.
+	Verbs []string `json:"verbs"`
+
+	// APIGroups matched by the rule. "" is the core API group and * matches all groups.
+	// +optional
+	APIGroups []string `json:"apiGroups,omitempty"`
+
+	// Resources matched by the rule, such as pods or pods/exec. * matches all
+	// resources and */subresource matches subresource of all resources.
+	// +optional
+	Resources []string `json:"resources,omitempty"`
+
+	// ResourceNames limits the rule to objects of these names.
+	// +optional
+	ResourceNames []string `json:"resourceNames,omitempty"`
+
+	// Namespaces limits the rule to namespaced requests in these namespaces.
+	// Without it, the rule matches cluster-scoped requests as well.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NonResourceURLs matched by the rule, such as /version or /apis/*.
+	// A trailing * matches any suffix.
+	// +optional
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+type ClusterStatus struct {
+	// Agent reports the rollout of the agent Deployment in the member cluster.
+	// +optional
+	Agent *ClusterAgentStatus `json:"agent,omitempty"`
+
+	// Health reports whether the apiserver of the member cluster is ready, as
+	// last probed by a hub holding a session to it.
+	// +optional
+	Health *ClusterHealthStatus `json:"health,omitempty"`
+
+	// Inventory describes the member cluster, as last probed by a hub holding a
+	// session to it.
+	// +optional
+	Inventory *ClusterInventoryStatus `json:"inventory,omitempty"`
+}
+
+type ClusterAgentStatus struct {
+	// Image the agent Deployment is set to run.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// DesiredImage is the image the hub rolls agents out to, if any.
+	// +optional
+	DesiredImage string `json:"desiredImage,omitempty"`
+
+	// Replicas is the number of desired agent pods.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// UpdatedReplicas is the number of agent pods running Image.
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// ReadyReplicas is the number of ready agent pods.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// LastUpdateTime is when this status last changed.
+	// +optional
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+type ClusterHealthStatus struct {
+	// Ready is true if the apiserver passed its readiness check.
+	Ready bool `json:"ready"`
+
+	// Message tells why the member cluster is not ready.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastProbeTime is when the member cluster was last probed.
+	// +optional
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+
+	// LastTransitionTime is when Ready last changed.
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+type ClusterInventoryStatus struct {
+	// KubernetesVersion is the git version of the apiserver, such as v1.21.2.
+	// +optional
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+
+	// Platform of the apiserver, such as linux/amd64.
+	// +optional
+	Platform string `json:"platform,omitempty"`
+
+	// Nodes is the number of nodes.
+	// +optional
+	Nodes int32 `json:"nodes,omitempty"`
+
+	// ReadyNodes is the number of nodes whose Ready condition is true.
+	// +optional
+	ReadyNodes int32 `json:"readyNodes,omitempty"`
+
+	// Capacity is the sum of the capacity of all nodes.
+	// +optional
+	Capacity corev1.ResourceList `json:"capacity,omitempty"`
+
+	// Allocatable is the sum of the allocatable resources of all nodes.
+	// +optional
+	Allocatable corev1.ResourceList `json:"allocatable,omitempty"`
+
+	// Providers of nodes, taken from the scheme of their provider IDs, such as aws or gce.
+	// +optional
+	Providers []string `json:"providers,omitempty"`
+
+	// Regions of nodes, taken from their topology.kubernetes.io/region label.
+	// +optional
+	Regions []string `json:"regions,omitempty"`
+
+	// Zones of nodes, taken from their topology.kubernetes.io/zone label.
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+
+	// Architectures of nodes, taken from their kubernetes.io/arch label.
+	// +optional
+	Architectures []string `json:"architectures,omitempty"`
+
+	// LastUpdateTime is when this inventory last changed.
+	// +optional
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
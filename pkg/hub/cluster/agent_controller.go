@@ -0,0 +1,289 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+	kopilotinformers "github.com/smartxworks/kopilot/pkg/client/informers/externalversions/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// AgentController rolls agents connected to this hub out to the image their
+// Cluster asks for, and reports the rollout in the status of the Cluster.
+// It also keeps agents up to date with the services and endpoints their
+// Cluster exposes, and the host services exposed to them.
+type AgentController struct {
+	client         clientset.Interface
+	lister         kopilotlisters.ClusterLister
+	sessionManager SessionManager
+	recorder       record.EventRecorder
+}
+
+func NewAgentController(client clientset.Interface, informer kopilotinformers.ClusterInformer, sessionManager SessionManager, recorder record.EventRecorder) *AgentController {
+	c := &AgentController{
+		client:         client,
+		lister:         informer.Lister(),
+		sessionManager: sessionManager,
+		recorder:       recorder,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			oldCluster := oldObj.(*kopilotv1alpha1.Cluster)
+			cluster := newObj.(*kopilotv1alpha1.Cluster)
+			if cluster.Spec.Suspended {
+				return
+			}
+			if !reflect.DeepEqual(oldCluster.Spec.Services, cluster.Spec.Services) {
+				go func() {
+					if err := c.syncServices(context.Background(), cluster); err != nil {
+						log.Printf("failed to sync services of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+					}
+				}()
+			}
+			if !reflect.DeepEqual(oldCluster.Spec.Endpoints, cluster.Spec.Endpoints) {
+				go func() {
+					if err := c.syncEndpoints(context.Background(), cluster); err != nil {
+						log.Printf("failed to sync endpoints of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+					}
+				}()
+			}
+			if !reflect.DeepEqual(oldCluster.Spec.HostServices, cluster.Spec.HostServices) {
+				go func() {
+					if err := c.syncHostServices(context.Background(), cluster); err != nil {
+						log.Printf("failed to sync host services of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+					}
+				}()
+			}
+		},
+	})
+	return c
+}
+
+func (c *AgentController) Start(ctx context.Context) error {
+	if hub.C.AgentSyncInterval <= 0 {
+		return nil
+	}
+	wait.UntilWithContext(ctx, c.syncAll, hub.C.AgentSyncInterval)
+	return nil
+}
+
+func (c *AgentController) syncAll(ctx context.Context) {
+	clusters, err := c.lister.List(labels.Everything())
+	if err != nil {
+		log.Printf("failed to list clusters: %s", err)
+		return
+	}
+
+	for _, cluster := range clusters {
+		if cluster.Spec.Suspended {
+			continue
+		}
+		if err := c.syncImage(ctx, cluster); err != nil {
+			log.Printf("failed to sync agent of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+		}
+		if err := c.syncServices(ctx, cluster); err != nil {
+			log.Printf("failed to sync services of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+		}
+		if err := c.syncEndpoints(ctx, cluster); err != nil {
+			log.Printf("failed to sync endpoints of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+		}
+		if err := c.syncHostServices(ctx, cluster); err != nil {
+			log.Printf("failed to sync host services of cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+		}
+	}
+}
+
+func (c *AgentController) syncImage(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	conn, err := c.sessionManager.DialCluster(key, tunnel.FeatureSelfUpgrade)
+	if err != nil {
+		// the agents are connected to another hub, not connected at all or predate self-upgrade
+		return nil
+	}
+	client := newControlClient(conn)
+	defer client.CloseIdleConnections()
+
+	var status tunnel.AgentStatus
+	if err := doControlRequest(ctx, client, http.MethodGet, tunnel.AgentStatusPath, nil, &status); err != nil {
+		return fmt.Errorf("get agent status: %s", err)
+	}
+
+	desiredImage := desiredAgentImage(cluster)
+	if desiredImage != "" && desiredImage != status.Image {
+		log.Printf("rolling out agent image %q to cluster %q, which runs %q", desiredImage, key, status.Image)
+		c.recorder.Eventf(cluster, corev1.EventTypeNormal, "AgentUpgrade", "Rolling out agent image %q, was %q", desiredImage, status.Image)
+		if err := doControlRequest(ctx, client, http.MethodPut, tunnel.AgentImagePath, &tunnel.AgentImage{Image: desiredImage}, &status); err != nil {
+			return fmt.Errorf("set agent image: %s", err)
+		}
+	}
+
+	agentStatus := &kopilotv1alpha1.ClusterAgentStatus{
+		Image:           status.Image,
+		DesiredImage:    desiredImage,
+		Replicas:        status.Replicas,
+		UpdatedReplicas: status.UpdatedReplicas,
+		ReadyReplicas:   status.ReadyReplicas,
+	}
+	if old := cluster.Status.Agent; old != nil {
+		agentStatus.LastUpdateTime = old.LastUpdateTime
+		if *agentStatus == *old {
+			return nil
+		}
+	}
+	now := metav1.Now()
+	agentStatus.LastUpdateTime = &now
+
+	cluster = cluster.DeepCopy()
+	cluster.Status.Agent = agentStatus
+	if _, err := c.client.KopilotV1alpha1().Clusters(cluster.Namespace).UpdateStatus(ctx, cluster, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update status: %s", err)
+	}
+	return nil
+}
+
+// syncServices sends the services exposed by cluster to each of its agents
+// connected to this hub.
+func (c *AgentController) syncServices(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	return c.putToAgents(ctx, cluster, tunnel.FeatureServiceProxy, tunnel.AgentServicesPath, tunnelServices(cluster))
+}
+
+// syncEndpoints sends the endpoints exposed by cluster to each of its agents
+// connected to this hub.
+func (c *AgentController) syncEndpoints(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	return c.putToAgents(ctx, cluster, tunnel.FeatureTCPForward, tunnel.AgentEndpointsPath, tunnelEndpoints(cluster))
+}
+
+// syncHostServices sends the host services exposed to cluster to each of its
+// agents connected to this hub.
+func (c *AgentController) syncHostServices(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	return c.putToAgents(ctx, cluster, tunnel.FeatureReverseTunnel, tunnel.AgentHostServicesPath, tunnelHostServices(cluster))
+}
+
+func (c *AgentController) putToAgents(ctx context.Context, cluster *kopilotv1alpha1.Cluster, feature string, path string, in interface{}) error {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	var errs []error
+	for _, conn := range c.sessionManager.DialClusterSessions(key, feature) {
+		client := newControlClient(conn)
+		var out json.RawMessage
+		if err := doControlRequest(ctx, client, http.MethodPut, path, in, &out); err != nil {
+			errs = append(errs, err)
+		}
+		client.CloseIdleConnections()
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// desiredAgentImage returns the image agents of cluster should run, or an
+// empty string if they are left alone.
+func desiredAgentImage(cluster *kopilotv1alpha1.Cluster) string {
+	spec := cluster.Spec.Agent
+	if spec == nil {
+		return hub.C.AgentImage
+	}
+	switch spec.UpgradePolicy {
+	case kopilotv1alpha1.AgentUpgradePolicyManual:
+		return ""
+	case kopilotv1alpha1.AgentUpgradePolicyPinned:
+		return spec.Image
+	default:
+		return hub.C.AgentImage
+	}
+}
+
+// agentImage returns the image of agents installed from the agent subresource.
+func agentImage(cluster *kopilotv1alpha1.Cluster) string {
+	if image := desiredAgentImage(cluster); image != "" {
+		return image
+	}
+	return hub.C.AgentImage
+}
+
+// newControlClient returns a client sending requests to the control API of
+// the agent on conn. Requests after the first reuse the same connection.
+func newControlClient(conn net.Conn) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				if conn == nil {
+					return nil, errors.New("connection to agent was closed")
+				}
+				c := conn
+				conn = nil
+				return c, nil
+			},
+			MaxIdleConnsPerHost: 1,
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+func doControlRequest(ctx context.Context, client *http.Client, method string, path string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(tunnel.TargetHeader, tunnel.TargetControl)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"io"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// effectiveCompression returns the compression agents of cluster are asked
+// to apply to responses, falling back to the defaults of the hub.
+func effectiveCompression(cluster *kopilotv1alpha1.Cluster) tunnel.Compression {
+	algorithm := hub.C.Compression
+	level := hub.C.CompressionLevel
+	if spec := cluster.Spec.Compression; spec != nil {
+		algorithm = string(spec.Algorithm)
+		if spec.Level != nil {
+			level = int(*spec.Level)
+		}
+	}
+	return tunnel.Compression{
+		Algorithm: strings.ToLower(algorithm),
+		Level:     level,
+	}
+}
+
+// decompressBody decompresses a response body compressed by the agent with
+// algorithm, counting the bytes before and after decompression. The
+// decompressor is created on the first read, as it blocks until the agent
+// sends the first data, which may take a while for watches.
+type decompressBody struct {
+	body         io.ReadCloser
+	algorithm    string
+	reader       io.ReadCloser
+	compressed   prometheus.Counter
+	uncompressed prometheus.Counter
+}
+
+func newDecompressBody(body io.ReadCloser, algorithm string, key types.NamespacedName) io.ReadCloser {
+	return &decompressBody{
+		body:         body,
+		algorithm:    algorithm,
+		compressed:   tunnelCompressedBytes.WithLabelValues(key.Namespace, key.Name, algorithm),
+		uncompressed: tunnelUncompressedBytes.WithLabelValues(key.Namespace, key.Name, algorithm),
+	}
+}
+
+func (b *decompressBody) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		reader, err := tunnel.NewReader(b.algorithm, &countingReader{Reader: b.body, counter: b.compressed})
+		if err != nil {
+			return 0, err
+		}
+		b.reader = reader
+	}
+	n, err := b.reader.Read(p)
+	b.uncompressed.Add(float64(n))
+	return n, err
+}
+
+func (b *decompressBody) Close() error {
+	if b.reader != nil {
+		b.reader.Close()
+	}
+	return b.body.Close()
+}
+
+type countingReader struct {
+	io.Reader
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
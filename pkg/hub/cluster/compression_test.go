@@ -0,0 +1,67 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"testing"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+func TestEffectiveCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		spec *kopilotv1alpha1.ClusterCompression
+		want tunnel.Compression
+	}{
+		{
+			name: "defaults of hub",
+			want: tunnel.Compression{Algorithm: tunnel.CompressionGzip, Level: 5},
+		},
+		{
+			name: "algorithm of cluster",
+			spec: &kopilotv1alpha1.ClusterCompression{Algorithm: "Deflate"},
+			want: tunnel.Compression{Algorithm: tunnel.CompressionDeflate, Level: 5},
+		},
+		{
+			name: "level of cluster",
+			spec: &kopilotv1alpha1.ClusterCompression{Algorithm: "Gzip", Level: int32Ptr(9)},
+			want: tunnel.Compression{Algorithm: tunnel.CompressionGzip, Level: 9},
+		},
+		{
+			name: "disabled for cluster",
+			spec: &kopilotv1alpha1.ClusterCompression{Algorithm: "None"},
+			want: tunnel.Compression{Algorithm: tunnel.CompressionNone, Level: 5},
+		},
+	}
+	defer func(c hub.Config) {
+		hub.C = c
+	}(hub.C)
+	hub.C.Compression = "Gzip"
+	hub.C.CompressionLevel = 5
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &kopilotv1alpha1.Cluster{}
+			cluster.Spec.Compression = tt.spec
+			if got := effectiveCompression(cluster); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotinformers "github.com/smartxworks/kopilot/pkg/client/informers/externalversions/kopilot/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// SessionController ties sessions to the lifecycle of their Cluster objects.
+// Sessions are closed when their cluster is deleted or suspended, or when the
+// token they were authenticated with is no longer the token of the cluster.
+type SessionController struct {
+	sessionManager SessionManager
+	recorder       record.EventRecorder
+}
+
+func NewSessionController(informer kopilotinformers.ClusterInformer, sessionManager SessionManager, recorder record.EventRecorder) *SessionController {
+	c := &SessionController{
+		sessionManager: sessionManager,
+		recorder:       recorder,
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			cluster := newObj.(*kopilotv1alpha1.Cluster)
+			if cluster.Spec.Suspended {
+				c.closeSessions(cluster, "suspension")
+				return
+			}
+			c.revokeSessions(cluster)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cluster, ok := obj.(*kopilotv1alpha1.Cluster); ok {
+				c.closeSessions(cluster, "deletion")
+			}
+		},
+	})
+	return c
+}
+
+func (c *SessionController) revokeSessions(cluster *kopilotv1alpha1.Cluster) {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	if n := c.sessionManager.RevokeClusterSessions(key, cluster.Token); n > 0 {
+		log.Printf("closed %d session(s) of cluster %q due to token change", n, key)
+		c.recorder.Eventf(cluster, corev1.EventTypeNormal, "SessionsRevoked", "Closed %d session(s) authenticated with a previous token", n)
+	}
+}
+
+func (c *SessionController) closeSessions(cluster *kopilotv1alpha1.Cluster, reason string) {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	if n := c.sessionManager.CloseClusterSessions(key); n > 0 {
+		log.Printf("closed %d session(s) of cluster %q due to %s", n, key, reason)
+		c.recorder.Eventf(cluster, corev1.EventTypeNormal, "SessionsClosed", "Closed %d session(s) due to cluster %s", n, reason)
+	}
+}
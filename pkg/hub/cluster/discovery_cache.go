@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/policy"
+)
+
+// maxDiscoveryCacheEntrySize bounds the responses kept by DiscoveryCache.
+// Larger responses are passed through without being cached.
+const maxDiscoveryCacheEntrySize = 32 << 20
+
+// DiscoveryCache keeps discovery and OpenAPI documents of clusters, which
+// clients such as kubectl fetch on every start and which change only when
+// the member apiserver does. Documents are served from the cache for
+// hub.C.DiscoveryCacheTTL and revalidated with their ETag afterwards. They
+// are only valid as long as the session they were fetched on, so that
+// reconnecting agents, for example after the member apiserver was upgraded,
+// start from scratch.
+type DiscoveryCache struct {
+	entries map[discoveryCacheKey]*discoveryCacheEntry
+	mutex   sync.Mutex
+}
+
+func NewDiscoveryCache() *DiscoveryCache {
+	return &DiscoveryCache{
+		entries: map[discoveryCacheKey]*discoveryCacheEntry{},
+	}
+}
+
+// discoveryCacheKey tells apart the representations of a document.
+type discoveryCacheKey struct {
+	cluster        types.NamespacedName
+	path           string
+	query          string
+	accept         string
+	acceptEncoding string
+}
+
+type discoveryCacheEntry struct {
+	sess    *yamux.Session
+	header  http.Header
+	body    []byte
+	etag    string
+	fetched time.Time
+}
+
+// isDiscoveryPath reports whether path of a member cluster serves discovery,
+// version or OpenAPI documents.
+func isDiscoveryPath(path string) bool {
+	switch {
+	case path == "/version", path == "/openapi/v2", path == "/openapi/v3", strings.HasPrefix(path, "/openapi/v3/"):
+		return true
+	case path == "/api", path == "/apis", strings.HasPrefix(path, "/api/"), strings.HasPrefix(path, "/apis/"):
+		return !policy.NewAttributes(http.MethodGet, path, nil).IsResourceRequest
+	}
+	return false
+}
+
+func newDiscoveryCacheKey(key types.NamespacedName, path string, r *http.Request) discoveryCacheKey {
+	return discoveryCacheKey{
+		cluster:        key,
+		path:           path,
+		query:          r.URL.RawQuery,
+		accept:         r.Header.Get("Accept"),
+		acceptEncoding: r.Header.Get("Accept-Encoding"),
+	}
+}
+
+// get returns the entry of key, or nil if there is none or the session it
+// was fetched on is gone.
+func (c *DiscoveryCache) get(key discoveryCacheKey) *discoveryCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+	if entry.sess.IsClosed() {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (c *DiscoveryCache) put(key discoveryCacheKey, entry *discoveryCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, e := range c.entries {
+		if e.sess.IsClosed() {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// update caches the response res to the request for key fetched on sess,
+// which revalidated stale if it is not nil. A 304 response is turned back
+// into the cached one, unless the client asked with the same ETag itself.
+func (c *DiscoveryCache) update(key discoveryCacheKey, stale *discoveryCacheEntry, clientETag string, sess *yamux.Session, res *http.Response) error {
+	if sess == nil {
+		return nil
+	}
+
+	if res.StatusCode == http.StatusNotModified && stale != nil && stale.etag != "" {
+		entry := &discoveryCacheEntry{
+			sess:    sess,
+			header:  stale.header,
+			body:    stale.body,
+			etag:    stale.etag,
+			fetched: time.Now(),
+		}
+		c.put(key, entry)
+		discoveryCacheRequests.WithLabelValues(key.cluster.Namespace, key.cluster.Name, "revalidated").Inc()
+		if clientETag != entry.etag {
+			entry.writeResponse(res)
+		}
+		return nil
+	}
+
+	discoveryCacheRequests.WithLabelValues(key.cluster.Namespace, key.cluster.Name, "miss").Inc()
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxDiscoveryCacheEntrySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDiscoveryCacheEntrySize {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return nil
+	}
+	res.Body.Close()
+
+	entry := &discoveryCacheEntry{
+		sess:    sess,
+		header:  res.Header.Clone(),
+		body:    body,
+		etag:    res.Header.Get("ETag"),
+		fetched: time.Now(),
+	}
+	c.put(key, entry)
+	entry.writeResponse(res)
+	return nil
+}
+
+// fresh reports whether the entry may be served without revalidation.
+func (e *discoveryCacheEntry) fresh() bool {
+	return time.Since(e.fetched) < hub.C.DiscoveryCacheTTL
+}
+
+// ServeHTTP serves the cached document, or 304 if the client has it already.
+func (e *discoveryCacheEntry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	if e.etag != "" && r.Header.Get("If-None-Match") == e.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+func (e *discoveryCacheEntry) writeResponse(res *http.Response) {
+	res.StatusCode = http.StatusOK
+	res.Status = http.StatusText(http.StatusOK)
+	res.Header = e.header.Clone()
+	res.Header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	res.ContentLength = int64(len(e.body))
+	res.Body = ioutil.NopCloser(bytes.NewReader(e.body))
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newTestSession returns the hub side of a session whose agent side accepts
+// nothing.
+func newTestSession(t *testing.T) *yamux.Session {
+	hubConn, agentConn := net.Pipe()
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = false
+	config.LogOutput = ioutil.Discard
+	sess, err := yamux.Client(hubConn, config)
+	if err != nil {
+		t.Fatalf("creating session: %s", err)
+	}
+	t.Cleanup(func() {
+		sess.Close()
+		agentConn.Close()
+	})
+	return sess
+}
+
+func TestIsDiscoveryPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/version", want: true},
+		{path: "/api", want: true},
+		{path: "/api/v1", want: true},
+		{path: "/apis", want: true},
+		{path: "/apis/apps", want: true},
+		{path: "/apis/apps/v1", want: true},
+		{path: "/openapi/v2", want: true},
+		{path: "/openapi/v3/apis/apps/v1", want: true},
+		{path: "/api/v1/pods"},
+		{path: "/apis/apps/v1/deployments"},
+		{path: "/api/v1/namespaces/default/pods"},
+		{path: "/healthz"},
+		{path: "/openapi/v2/extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := isDiscoveryPath(tt.path); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryCacheUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		stale      bool
+		clientETag string
+		status     int
+		body       string
+		etag       string
+		wantStatus int
+		wantBody   string
+		wantCached string
+	}{
+		{
+			name:       "miss",
+			status:     http.StatusOK,
+			body:       "fresh",
+			etag:       `"b"`,
+			wantStatus: http.StatusOK,
+			wantBody:   "fresh",
+			wantCached: "fresh",
+		},
+		{
+			name:       "error response is not cached",
+			status:     http.StatusForbidden,
+			body:       "forbidden",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "forbidden",
+		},
+		{
+			name:       "changed document replaces the stale one",
+			stale:      true,
+			status:     http.StatusOK,
+			body:       "fresh",
+			etag:       `"b"`,
+			wantStatus: http.StatusOK,
+			wantBody:   "fresh",
+			wantCached: "fresh",
+		},
+		{
+			name:       "revalidated document is served from the cache",
+			stale:      true,
+			status:     http.StatusNotModified,
+			wantStatus: http.StatusOK,
+			wantBody:   "stale",
+			wantCached: "stale",
+		},
+		{
+			name:       "revalidated document the client has already",
+			stale:      true,
+			clientETag: `"a"`,
+			status:     http.StatusNotModified,
+			wantStatus: http.StatusNotModified,
+			wantCached: "stale",
+		},
+		{
+			name:       "not modified for the client only",
+			clientETag: `"a"`,
+			status:     http.StatusNotModified,
+			wantStatus: http.StatusNotModified,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newTestSession(t)
+			c := NewDiscoveryCache()
+			key := discoveryCacheKey{cluster: types.NamespacedName{Namespace: "default", Name: "sample"}, path: "/apis"}
+			var stale *discoveryCacheEntry
+			if tt.stale {
+				stale = &discoveryCacheEntry{
+					sess:    sess,
+					header:  http.Header{"Etag": {`"a"`}},
+					body:    []byte("stale"),
+					etag:    `"a"`,
+					fetched: time.Now().Add(-time.Hour),
+				}
+				c.put(key, stale)
+			}
+
+			res := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+			}
+			if tt.etag != "" {
+				res.Header.Set("ETag", tt.etag)
+			}
+			if err := c.update(key, stale, tt.clientETag, sess, res); err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+				t.Errorf("got response %d %q, want %d %q", res.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			entry := c.get(key)
+			switch {
+			case tt.wantCached == "" && entry != nil:
+				t.Errorf("got cached %q, want nothing", entry.body)
+			case tt.wantCached != "" && entry == nil:
+				t.Errorf("got nothing cached, want %q", tt.wantCached)
+			case entry != nil && (string(entry.body) != tt.wantCached || !entry.fresh()):
+				t.Errorf("got cached %q, fresh %t, want fresh %q", entry.body, entry.fresh(), tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestDiscoveryCacheSession(t *testing.T) {
+	c := NewDiscoveryCache()
+	cluster := types.NamespacedName{Namespace: "default", Name: "sample"}
+	closedKey := discoveryCacheKey{cluster: cluster, path: "/api"}
+	openKey := discoveryCacheKey{cluster: cluster, path: "/apis"}
+	closed := newTestSession(t)
+	open := newTestSession(t)
+
+	c.put(closedKey, &discoveryCacheEntry{sess: closed, fetched: time.Now()})
+	c.put(openKey, &discoveryCacheEntry{sess: open, fetched: time.Now()})
+	closed.Close()
+
+	if c.get(closedKey) != nil {
+		t.Error("got entry fetched on a closed session, want none")
+	}
+	if c.get(openKey) == nil {
+		t.Error("got no entry fetched on an open session, want one")
+	}
+
+	// entries of closed sessions are dropped as others are added
+	c.entries[closedKey] = &discoveryCacheEntry{sess: closed}
+	c.put(discoveryCacheKey{cluster: cluster, path: "/version"}, &discoveryCacheEntry{sess: open})
+	if _, ok := c.entries[closedKey]; ok {
+		t.Error("entry fetched on a closed session kept, want it dropped")
+	}
+}
+
+func TestDiscoveryCacheEntryServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:       "document",
+			wantStatus: http.StatusOK,
+			wantBody:   "doc",
+		},
+		{
+			name:        "document the client has",
+			ifNoneMatch: `"a"`,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			name:        "document the client has another version of",
+			ifNoneMatch: `"b"`,
+			wantStatus:  http.StatusOK,
+			wantBody:    "doc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &discoveryCacheEntry{
+				header: http.Header{"Etag": {`"a"`}, "Content-Type": {"application/json"}},
+				body:   []byte("doc"),
+				etag:   `"a"`,
+			}
+			r := httptest.NewRequest(http.MethodGet, "/apis", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			entry.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := w.Header().Get("ETag"); got != `"a"` {
+				t.Errorf("got ETag %q, want %q", got, `"a"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	subresourceserver "github.com/smartxworks/kubernetes-subresource-server-runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// NewEndpointsSubresource turns upgrade requests on endpoints/{endpoint} into
+// raw TCP connections to the endpoints exposed by a Cluster.
+func NewEndpointsSubresource(lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter) *subresourceserver.Subresource {
+	return &subresourceserver.Subresource{
+		NamespaceScoped:      true,
+		GroupVersionResource: GroupVersionResource,
+		Name:                 "endpoints",
+		Route: func(ctx context.Context, key types.NamespacedName, path string) (http.Handler, error) {
+			name := strings.TrimPrefix(path, "/")
+			if name == "" || strings.Contains(name, "/") {
+				return http.NotFoundHandler(), nil
+			}
+			return NewProxyHandler(lister, sessionManager, peerManager, limiter, nil, key, tunnel.EndpointTarget(name), "/"), nil
+		},
+	}
+}
+
+func findEndpoint(cluster *kopilotv1alpha1.Cluster, name string) *kopilotv1alpha1.ClusterEndpoint {
+	for i := range cluster.Spec.Endpoints {
+		if cluster.Spec.Endpoints[i].Name == name {
+			return &cluster.Spec.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// tunnelEndpoints returns the endpoints agents of cluster may forward to.
+func tunnelEndpoints(cluster *kopilotv1alpha1.Cluster) []tunnel.Endpoint {
+	endpoints := []tunnel.Endpoint{}
+	for _, e := range cluster.Spec.Endpoints {
+		endpoints = append(endpoints, tunnel.Endpoint{
+			Name:    e.Name,
+			Address: e.Address,
+		})
+	}
+	return endpoints
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	subresourceserver "github.com/smartxworks/kubernetes-subresource-server-runtime"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/policy"
+)
+
+// ClusterAnnotation is set on every object returned by a fan-out request to
+// the namespace/name of the Cluster it came from.
+var ClusterAnnotation = fmt.Sprintf("%s/cluster", kopilotv1alpha1.SchemeGroupVersion.Group)
+
+// fanoutAll stands for all namespaces or all clusters in fan-out paths.
+const fanoutAll = "-"
+
+const maxFanoutErrorBodySize = 1 << 20
+
+func NewFanoutSubresource(kubeClient kubernetes.Interface, lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter) *subresourceserver.Subresource {
+	return &subresourceserver.Subresource{
+		NamespaceScoped:      true,
+		GroupVersionResource: GroupVersionResource,
+		Name:                 "fanout",
+		ConnectMethods:       []string{http.MethodGet},
+		Connect: func(ctx context.Context, key types.NamespacedName) (http.Handler, error) {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				policy.WriteStatusError(w, apierrors.NewBadRequest("path of a list or watch in member clusters is required"))
+			}), nil
+		},
+		Route: func(ctx context.Context, key types.NamespacedName, path string) (http.Handler, error) {
+			return NewFanoutHandler(kubeClient, lister, sessionManager, peerManager, limiter, key, path), nil
+		},
+	}
+}
+
+// NewFanoutHandler sends a list or watch to every Cluster matching the
+// clusterSelector query parameter which the user is allowed to proxy, and
+// merges the results. The namespace of key restricts the Clusters unless it
+// is "-", and the name of key must be "-". Failures of single clusters are
+// reported along with the results of the others.
+func NewFanoutHandler(kubeClient kubernetes.Interface, lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter, key types.NamespacedName, subpath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key.Name != fanoutAll {
+			policy.WriteStatusError(w, apierrors.NewBadRequest(fmt.Sprintf("fan-out requests must address cluster %q", fanoutAll)))
+			return
+		}
+
+		query := r.URL.Query()
+		selector, err := labels.Parse(query.Get("clusterSelector"))
+		if err != nil {
+			policy.WriteStatusError(w, apierrors.NewBadRequest(fmt.Sprintf("invalid clusterSelector: %s", err)))
+			return
+		}
+		query.Del("clusterSelector")
+
+		watch := isWatch(subpath, query)
+		if !watch && (query.Get("limit") != "" || query.Get("continue") != "") {
+			policy.WriteStatusError(w, apierrors.NewBadRequest("lists across clusters cannot be paginated"))
+			return
+		}
+		if rv := query.Get("resourceVersion"); (rv != "" && rv != "0") || query.Get("resourceVersionMatch") != "" {
+			policy.WriteStatusError(w, apierrors.NewBadRequest("resource versions differ between clusters, so only an empty or \"0\" resourceVersion is allowed across clusters"))
+			return
+		}
+
+		var clusters []*kopilotv1alpha1.Cluster
+		if key.Namespace == fanoutAll {
+			clusters, err = lister.List(selector)
+		} else {
+			clusters, err = lister.Clusters(key.Namespace).List(selector)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list clusters: %s", err), http.StatusInternalServerError)
+			return
+		}
+		sort.Slice(clusters, func(i, j int) bool {
+			if clusters[i].Namespace != clusters[j].Namespace {
+				return clusters[i].Namespace < clusters[j].Namespace
+			}
+			return clusters[i].Name < clusters[j].Name
+		})
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		workers := hub.C.FanoutWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		// held by each cluster while it is reviewed and requested, and for lists
+		// while the response is read
+		pool := make(chan struct{}, workers)
+
+		user := userFromRequest(r)
+		fanout := func(cluster *kopilotv1alpha1.Cluster) *http.Response {
+			key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+			allowed, err := user.can(ctx, kubeClient, "get", "proxy", key.Namespace, key.Name)
+			if err != nil {
+				statusErr := apierrors.NewInternalError(fmt.Errorf("review access to cluster: %s", err))
+				return serveResponse(key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					policy.WriteStatusError(w, statusErr)
+				}), r)
+			}
+			// clusters the user may not proxy are left out as if they did not match
+			if !allowed {
+				return nil
+			}
+
+			req := r.Clone(ctx)
+			req.URL.RawQuery = query.Encode()
+			req.Body = http.NoBody
+			// results are decoded to be merged, so they must be uncompressed JSON
+			req.Header.Set("Accept", "application/json")
+			req.Header.Del("Accept-Encoding")
+			return serveResponse(key, NewProxyHandler(lister, sessionManager, peerManager, limiter, nil, key, "", subpath), req)
+		}
+
+		if watch {
+			serveFanoutWatch(w, ctx, cancel, clusters, pool, fanout)
+		} else {
+			serveFanoutList(w, clusters, pool, fanout)
+		}
+	})
+}
+
+// fanoutClusterError reports the failure of a single cluster in a merged list.
+type fanoutClusterError struct {
+	Cluster string         `json:"cluster"`
+	Status  *metav1.Status `json:"status"`
+}
+
+func serveFanoutList(w http.ResponseWriter, clusters []*kopilotv1alpha1.Cluster, pool chan struct{}, fanout func(*kopilotv1alpha1.Cluster) *http.Response) {
+	type result struct {
+		object map[string]interface{}
+		status *metav1.Status
+	}
+	results := make([]result, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		wg.Add(1)
+		pool <- struct{}{}
+		go func(i int, cluster *kopilotv1alpha1.Cluster) {
+			defer wg.Done()
+			defer func() { <-pool }()
+			res := fanout(cluster)
+			if res == nil {
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				results[i].status = responseStatus(res)
+				return
+			}
+			decoder := json.NewDecoder(res.Body)
+			decoder.UseNumber()
+			if err := decoder.Decode(&results[i].object); err != nil {
+				results[i].status = internalErrorStatus(fmt.Errorf("decode response: %s", err))
+			}
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	list := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"metadata":   map[string]interface{}{},
+	}
+	items := []interface{}{}
+	var clusterErrors []fanoutClusterError
+	kindSet := false
+	for i, result := range results {
+		key := clusters[i].Namespace + "/" + clusters[i].Name
+		if result.status != nil {
+			clusterErrors = append(clusterErrors, fanoutClusterError{Cluster: key, Status: result.status})
+			continue
+		}
+		if result.object == nil {
+			continue
+		}
+
+		clusterItems, isList := result.object["items"].([]interface{})
+		if !isList {
+			// a single object, such as the response to a get
+			annotateObject(result.object, key)
+			items = append(items, result.object)
+			continue
+		}
+		if !kindSet {
+			list["apiVersion"] = result.object["apiVersion"]
+			list["kind"] = result.object["kind"]
+			kindSet = true
+		}
+		for _, item := range clusterItems {
+			if object, ok := item.(map[string]interface{}); ok {
+				annotateObject(object, key)
+			}
+			items = append(items, item)
+		}
+	}
+	list["items"] = items
+	if len(clusterErrors) > 0 {
+		list["clusterErrors"] = clusterErrors
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Printf("failed to write merged list: %s", err)
+	}
+}
+
+type fanoutWatchEvent struct {
+	Type   string                 `json:"type"`
+	Object map[string]interface{} `json:"object"`
+}
+
+// serveFanoutWatch merges the watch events of all clusters. A cluster which
+// fails to start its watch is reported by an ERROR event, and the merged
+// watch ends as soon as the watch of any cluster ends, so that clients
+// resume all of them as they would resume a single watch.
+func serveFanoutWatch(w http.ResponseWriter, ctx context.Context, cancel context.CancelFunc, clusters []*kopilotv1alpha1.Cluster, pool chan struct{}, fanout func(*kopilotv1alpha1.Cluster) *http.Response) {
+	events := make(chan fanoutWatchEvent)
+	send := func(event fanoutWatchEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, cluster := range clusters {
+		wg.Add(1)
+		go func(cluster *kopilotv1alpha1.Cluster) {
+			defer wg.Done()
+			key := cluster.Namespace + "/" + cluster.Name
+			select {
+			case pool <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			res := fanout(cluster)
+			<-pool
+			if res == nil {
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				send(errorEvent(key, responseStatus(res)))
+				return
+			}
+			// only a watch which was established ends the merged watch
+			defer cancel()
+
+			decoder := json.NewDecoder(res.Body)
+			decoder.UseNumber()
+			for {
+				var event fanoutWatchEvent
+				if err := decoder.Decode(&event); err != nil {
+					if err != io.EOF && ctx.Err() == nil {
+						send(errorEvent(key, internalErrorStatus(fmt.Errorf("decode watch event: %s", err))))
+					}
+					return
+				}
+				if event.Type == "ERROR" {
+					event = errorEvent(key, objectStatus(event.Object))
+				} else if event.Object != nil {
+					annotateObject(event.Object, key)
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}(cluster)
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			return
+		case <-allDone:
+			return
+		}
+	}
+}
+
+func annotateObject(object map[string]interface{}, cluster string) {
+	u := unstructured.Unstructured{Object: object}
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ClusterAnnotation] = cluster
+	u.SetAnnotations(annotations)
+}
+
+func errorEvent(cluster string, status *metav1.Status) fanoutWatchEvent {
+	status.Message = fmt.Sprintf("cluster %q: %s", cluster, status.Message)
+	data, _ := json.Marshal(status)
+	var object map[string]interface{}
+	json.Unmarshal(data, &object)
+	return fanoutWatchEvent{Type: "ERROR", Object: object}
+}
+
+// responseStatus returns the Status carried by a failed response, or makes
+// one up from its code and body.
+func responseStatus(res *http.Response) *metav1.Status {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxFanoutErrorBodySize))
+	var status metav1.Status
+	if err := json.Unmarshal(body, &status); err == nil && status.Kind == "Status" {
+		return &status
+	}
+	status = apierrors.NewGenericServerResponse(res.StatusCode, "get", schema.GroupResource{}, "", strings.TrimSpace(string(body)), 0, false).Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	return &status
+}
+
+func internalErrorStatus(err error) *metav1.Status {
+	status := apierrors.NewInternalError(err).Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	return &status
+}
+
+func objectStatus(object map[string]interface{}) *metav1.Status {
+	data, _ := json.Marshal(object)
+	var status metav1.Status
+	json.Unmarshal(data, &status)
+	return &status
+}
+
+// serveResponse runs handler in the background and returns its response as
+// soon as the handler has written the header, so that watches can be read
+// while they are open. Closing the body of the response makes further writes
+// of the handler fail.
+func serveResponse(key types.NamespacedName, handler http.Handler, r *http.Request) *http.Response {
+	w := newResponseWriter()
+	go func() {
+		defer w.close()
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				log.Printf("panic serving fan-out request to cluster %q: %v", key, err)
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	}()
+	<-w.ready
+	return w.res
+}
+
+// responseWriter pipes what a handler writes into an http.Response.
+type responseWriter struct {
+	header http.Header
+	res    *http.Response
+	pw     *io.PipeWriter
+	ready  chan struct{}
+	once   sync.Once
+}
+
+var _ http.Flusher = &responseWriter{}
+
+func newResponseWriter() *responseWriter {
+	pr, pw := io.Pipe()
+	return &responseWriter{
+		header: http.Header{},
+		res:    &http.Response{Body: pr},
+		pw:     pw,
+		ready:  make(chan struct{}),
+	}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.once.Do(func() {
+		w.res.StatusCode = code
+		w.res.Header = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+func (w *responseWriter) Flush() {}
+
+func (w *responseWriter) close() {
+	w.WriteHeader(http.StatusOK)
+	w.pw.Close()
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+)
+
+const forbiddenStatus = `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"pods is forbidden","reason":"Forbidden","code":403}`
+
+// fanoutResponse is what a cluster answers to a fan-out request.
+type fanoutResponse struct {
+	code int
+	body string
+}
+
+// testFanout returns the clusters named by responses, sorted, and a fan-out
+// answering each with its response. Clusters without a response are left
+// out as if the user could not proxy them. Successful responses are held
+// open until release is closed.
+func testFanout(responses map[string]*fanoutResponse, release chan struct{}) ([]*kopilotv1alpha1.Cluster, func(*kopilotv1alpha1.Cluster) *http.Response) {
+	var clusters []*kopilotv1alpha1.Cluster
+	for name := range responses {
+		clusters = append(clusters, &kopilotv1alpha1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		})
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+	fanout := func(cluster *kopilotv1alpha1.Cluster) *http.Response {
+		res := responses[cluster.Name]
+		if res == nil {
+			return nil
+		}
+		key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		return serveResponse(key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(res.code)
+			w.Write([]byte(res.body))
+			if res.code == http.StatusOK && release != nil {
+				<-release
+			}
+		}), r)
+	}
+	return clusters, fanout
+}
+
+func TestServeFanoutList(t *testing.T) {
+	tests := []struct {
+		name       string
+		responses  map[string]*fanoutResponse
+		wantKind   string
+		wantItems  []string
+		wantErrors []string
+	}{
+		{
+			name: "lists merged",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[{"metadata":{"name":"x"}},{"metadata":{"name":"y","annotations":{"k":"v"}}}]}`},
+				"b": {code: http.StatusOK, body: `{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"9"},"items":[{"metadata":{"name":"z"}}]}`},
+			},
+			wantKind:  "PodList",
+			wantItems: []string{"default/a x", "default/a y", "default/b z"},
+		},
+		{
+			name: "single objects merged",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"kind":"Namespace","apiVersion":"v1","metadata":{"name":"default"}}`},
+				"b": {code: http.StatusOK, body: `{"kind":"Namespace","apiVersion":"v1","metadata":{"name":"default"}}`},
+			},
+			wantKind:  "List",
+			wantItems: []string{"default/a default", "default/b default"},
+		},
+		{
+			name: "failed clusters reported next to the others",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"kind":"PodList","apiVersion":"v1","metadata":{},"items":[{"metadata":{"name":"x"}}]}`},
+				"b": {code: http.StatusForbidden, body: forbiddenStatus},
+				"c": {code: http.StatusBadGateway, body: "bad gateway\n"},
+				"d": {code: http.StatusOK, body: `{"kind":`},
+			},
+			wantKind:   "PodList",
+			wantItems:  []string{"default/a x"},
+			wantErrors: []string{"default/b 403 pods is forbidden", `default/c 502 an error on the server ("bad gateway")`, "default/d 500"},
+		},
+		{
+			name: "clusters left out",
+			responses: map[string]*fanoutResponse{
+				"a": nil,
+			},
+			wantKind: "List",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters, fanout := testFanout(tt.responses, nil)
+			w := httptest.NewRecorder()
+			serveFanoutList(w, clusters, make(chan struct{}, 1), fanout)
+
+			var list struct {
+				Kind     string `json:"kind"`
+				Metadata struct {
+					ResourceVersion string `json:"resourceVersion"`
+				} `json:"metadata"`
+				Items         []metav1.PartialObjectMetadata `json:"items"`
+				ClusterErrors []fanoutClusterError           `json:"clusterErrors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatalf("decoding merged list %q: %s", w.Body.String(), err)
+			}
+			if list.Kind != tt.wantKind {
+				t.Errorf("got kind %q, want %q", list.Kind, tt.wantKind)
+			}
+			if list.Metadata.ResourceVersion != "" {
+				t.Errorf("got resourceVersion %q, want none", list.Metadata.ResourceVersion)
+			}
+			var items []string
+			for _, item := range list.Items {
+				items = append(items, item.Annotations[ClusterAnnotation]+" "+item.Name)
+			}
+			if fmt.Sprint(items) != fmt.Sprint(tt.wantItems) {
+				t.Errorf("got items %v, want %v", items, tt.wantItems)
+			}
+			var errors []string
+			for _, e := range list.ClusterErrors {
+				errors = append(errors, strings.TrimSpace(fmt.Sprintf("%s %d %s", e.Cluster, e.Status.Code, e.Status.Message)))
+			}
+			for i := range errors {
+				// decode errors carry the message of the decoder
+				if i < len(tt.wantErrors) && strings.HasPrefix(errors[i], tt.wantErrors[i]) {
+					errors[i] = tt.wantErrors[i]
+				}
+			}
+			if fmt.Sprint(errors) != fmt.Sprint(tt.wantErrors) {
+				t.Errorf("got cluster errors %v, want %v", errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+// lineRecorder records what is written to it and signals each line written.
+type lineRecorder struct {
+	header http.Header
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	lines  chan struct{}
+}
+
+func (r *lineRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *lineRecorder) WriteHeader(code int) {}
+
+func (r *lineRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range p {
+		if c == '\n' {
+			r.lines <- struct{}{}
+		}
+	}
+	return r.buf.Write(p)
+}
+
+func (r *lineRecorder) Flush() {}
+
+func TestServeFanoutWatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string]*fanoutResponse
+		want      []string
+	}{
+		{
+			name: "events annotated with their cluster",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"type":"ADDED","object":{"metadata":{"name":"x"}}}` + "\n"},
+				"b": {code: http.StatusOK, body: `{"type":"ADDED","object":{"metadata":{"name":"y"}}}` + "\n" + `{"type":"DELETED","object":{"metadata":{"name":"y"}}}`},
+			},
+			want: []string{"ADDED default/a x", "ADDED default/b y", "DELETED default/b y"},
+		},
+		{
+			name: "failed watch reported by an ERROR event",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"type":"ADDED","object":{"metadata":{"name":"x"}}}` + "\n"},
+				"b": {code: http.StatusForbidden, body: forbiddenStatus},
+			},
+			want: []string{"ADDED default/a x", `ERROR 403 cluster "default/b": pods is forbidden`},
+		},
+		{
+			name: "ERROR event of a cluster names it",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: `{"type":"ERROR","object":{"kind":"Status","apiVersion":"v1","status":"Failure","message":"too old resource version","reason":"Expired","code":410}}` + "\n"},
+			},
+			want: []string{`ERROR 410 cluster "default/a": too old resource version`},
+		},
+		{
+			name: "undecodable event",
+			responses: map[string]*fanoutResponse{
+				"a": {code: http.StatusOK, body: "not json\n"},
+			},
+			want: []string{`ERROR 500 cluster "default/a": Internal error occurred: decode watch event`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			clusters, fanout := testFanout(tt.responses, release)
+			w := &lineRecorder{header: http.Header{}, lines: make(chan struct{}, 100)}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveFanoutWatch(w, ctx, cancel, clusters, make(chan struct{}, 1), fanout)
+			}()
+
+			for range tt.want {
+				select {
+				case <-w.lines:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for events, got %q", w.buf.String())
+				}
+			}
+			// the end of any watch ends the merged watch
+			close(release)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("merged watch did not end")
+			}
+
+			var events []string
+			decoder := json.NewDecoder(&w.buf)
+			for decoder.More() {
+				var event struct {
+					Type   string `json:"type"`
+					Object struct {
+						Metadata metav1.ObjectMeta `json:"metadata"`
+						Code     int               `json:"code"`
+						Message  string            `json:"message"`
+					} `json:"object"`
+				}
+				if err := decoder.Decode(&event); err != nil {
+					t.Fatalf("decoding merged watch: %s", err)
+				}
+				if event.Type == "ERROR" {
+					events = append(events, fmt.Sprintf("ERROR %d %s", event.Object.Code, event.Object.Message))
+				} else {
+					events = append(events, fmt.Sprintf("%s %s %s", event.Type, event.Object.Metadata.Annotations[ClusterAnnotation], event.Object.Metadata.Name))
+				}
+			}
+			sort.Strings(events)
+			for i := range events {
+				// decode errors carry the message of the decoder
+				if i < len(tt.want) && strings.HasPrefix(events[i], tt.want[i]) {
+					events[i] = tt.want[i]
+				}
+			}
+			if fmt.Sprint(events) != fmt.Sprint(tt.want) {
+				t.Errorf("got events %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFanoutHandlerRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster string
+		query   string
+	}{
+		{
+			name:    "single cluster",
+			cluster: "sample",
+		},
+		{
+			name:    "invalid cluster selector",
+			cluster: fanoutAll,
+			query:   "clusterSelector=env+in+(",
+		},
+		{
+			name:    "paginated list",
+			cluster: fanoutAll,
+			query:   "limit=10",
+		},
+		{
+			name:    "list from a resource version",
+			cluster: fanoutAll,
+			query:   "resourceVersion=12345",
+		},
+		{
+			name:    "watch from a resource version",
+			cluster: fanoutAll,
+			query:   "watch=true&resourceVersion=12345",
+		},
+		{
+			name:    "resource version match",
+			cluster: fanoutAll,
+			query:   "resourceVersion=0&resourceVersionMatch=NotOlderThan",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := types.NamespacedName{Namespace: fanoutAll, Name: tt.cluster}
+			h := NewFanoutHandler(nil, nil, nil, nil, nil, key, "/api/v1/pods")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/pods?"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got %d %q, want %d", w.Code, w.Body.String(), http.StatusBadRequest)
+			}
+		})
+	}
+}
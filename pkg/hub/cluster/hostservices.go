@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// serveHostServices serves the streams the agent opens on sess, which carry
+// connections of member workloads to the host services exposed by the Cluster.
+func serveHostServices(lister kopilotlisters.ClusterLister, key types.NamespacedName, sess *yamux.Session) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cluster, err := lister.Clusters(key.Namespace).Get(key.Name)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					return
+				}
+				http.Error(w, fmt.Sprintf("failed to get cluster: %s", err), http.StatusInternalServerError)
+				return
+			}
+
+			if cluster.Spec.Suspended {
+				http.Error(w, fmt.Sprintf("cluster %q is suspended", key), http.StatusForbidden)
+				return
+			}
+
+			target := r.Header.Get(tunnel.TargetHeader)
+			if !strings.HasPrefix(target, tunnel.TargetHostServicePrefix) {
+				http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+				return
+			}
+			name := strings.TrimPrefix(target, tunnel.TargetHostServicePrefix)
+			service := findHostService(cluster, name)
+			if service == nil {
+				http.Error(w, fmt.Sprintf("host service %q is not exposed", name), http.StatusNotFound)
+				return
+			}
+			tunnel.UpgradeToTCP(w, r, service.Address)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if err := server.Serve(sess); err != nil && !sess.IsClosed() {
+		log.Printf("error serving host services to cluster %q: %s", key, err)
+	}
+}
+
+func findHostService(cluster *kopilotv1alpha1.Cluster, name string) *kopilotv1alpha1.ClusterHostService {
+	for i := range cluster.Spec.HostServices {
+		if cluster.Spec.HostServices[i].Name == name {
+			return &cluster.Spec.HostServices[i]
+		}
+	}
+	return nil
+}
+
+// tunnelHostServices returns the host services agents of cluster forward
+// connections to. Their addresses in the host cluster are not revealed.
+func tunnelHostServices(cluster *kopilotv1alpha1.Cluster) []tunnel.HostService {
+	services := []tunnel.HostService{}
+	for _, s := range cluster.Spec.HostServices {
+		services = append(services, tunnel.HostService{
+			Name: s.Name,
+			Port: s.Port,
+		})
+	}
+	return services
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+// buildKubeconfig returns a kubeconfig with one context per cluster, pointing
+// at the proxy subresource of each cluster via kube-apiserver. Contexts are
+// named after their clusters; clusters outside the namespace of current are
+// prefixed with their namespace. The user entry carries no credentials, as
+// those of the host cluster user are never seen by the hub.
+func buildKubeconfig(clusters []*kopilotv1alpha1.Cluster, current types.NamespacedName, userName string, caData []byte) *clientcmdapi.Config {
+	if userName == "" {
+		userName = "user"
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.AuthInfos[userName] = clientcmdapi.NewAuthInfo()
+	proxySubresource := NewProxySubresource(nil, nil, nil, nil, nil)
+	for _, cluster := range clusters {
+		key := types.NamespacedName{
+			Namespace: cluster.Namespace,
+			Name:      cluster.Name,
+		}
+		name := kubeconfigContextName(key, current.Namespace)
+
+		c := clientcmdapi.NewCluster()
+		c.Server = fmt.Sprintf("https://%s%s", hub.KubeAPIServerAddr(), proxySubresource.Path(key))
+		c.CertificateAuthorityData = caData
+		config.Clusters[name] = c
+
+		ctx := clientcmdapi.NewContext()
+		ctx.Cluster = name
+		ctx.AuthInfo = userName
+		config.Contexts[name] = ctx
+
+		if key == current {
+			config.CurrentContext = name
+		}
+	}
+	return config
+}
+
+func kubeconfigContextName(key types.NamespacedName, namespace string) string {
+	if key.Namespace == namespace {
+		return key.Name
+	}
+	return fmt.Sprintf("%s_%s", key.Namespace, key.Name)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+func TestBuildKubeconfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		apiServerAddr string
+		clusters      []types.NamespacedName
+		current       types.NamespacedName
+		userName      string
+		wantServers   map[string]string
+		wantCurrent   string
+		wantUser      string
+	}{
+		{
+			name:        "single cluster",
+			clusters:    []types.NamespacedName{{Namespace: "default", Name: "a"}},
+			current:     types.NamespacedName{Namespace: "default", Name: "a"},
+			userName:    "alice",
+			wantServers: map[string]string{"a": "https://host.example.com:6443/apis/subresource.kopilot.smartx.com/v1alpha1/namespaces/default/clusters/a/proxy"},
+			wantCurrent: "a",
+			wantUser:    "alice",
+		},
+		{
+			name: "clusters of other namespaces are prefixed",
+			clusters: []types.NamespacedName{
+				{Namespace: "default", Name: "a"},
+				{Namespace: "team", Name: "a"},
+				{Namespace: "team", Name: "b"},
+			},
+			current: types.NamespacedName{Namespace: "team", Name: "b"},
+			wantServers: map[string]string{
+				"default_a": "https://host.example.com:6443/apis/subresource.kopilot.smartx.com/v1alpha1/namespaces/default/clusters/a/proxy",
+				"a":         "https://host.example.com:6443/apis/subresource.kopilot.smartx.com/v1alpha1/namespaces/team/clusters/a/proxy",
+				"b":         "https://host.example.com:6443/apis/subresource.kopilot.smartx.com/v1alpha1/namespaces/team/clusters/b/proxy",
+			},
+			wantCurrent: "b",
+			wantUser:    "user",
+		},
+		{
+			name:          "address of kube-apiserver",
+			apiServerAddr: "kube.example.com",
+			clusters:      []types.NamespacedName{{Namespace: "default", Name: "a"}},
+			current:       types.NamespacedName{Namespace: "default", Name: "b"},
+			wantServers:   map[string]string{"a": "https://kube.example.com/apis/subresource.kopilot.smartx.com/v1alpha1/namespaces/default/clusters/a/proxy"},
+			wantUser:      "user",
+		},
+	}
+	defer func(c hub.Config) {
+		hub.C = c
+	}(hub.C)
+	hub.C.PublicAddr = "host.example.com:6443"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub.C.APIServerAddr = tt.apiServerAddr
+			var clusters []*kopilotv1alpha1.Cluster
+			for _, key := range tt.clusters {
+				clusters = append(clusters, &kopilotv1alpha1.Cluster{
+					ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+				})
+			}
+
+			config := buildKubeconfig(clusters, tt.current, tt.userName, []byte("ca"))
+			if err := clientcmd.Validate(*config); err != nil {
+				t.Fatalf("got invalid kubeconfig: %s", err)
+			}
+
+			servers := map[string]string{}
+			for name, ctx := range config.Contexts {
+				if ctx.Cluster != name || ctx.AuthInfo != tt.wantUser {
+					t.Errorf("got context %q of cluster %q and user %q, want cluster %q and user %q", name, ctx.Cluster, ctx.AuthInfo, name, tt.wantUser)
+				}
+				if ca := string(config.Clusters[ctx.Cluster].CertificateAuthorityData); ca != "ca" {
+					t.Errorf("got CA data %q of cluster %q, want %q", ca, name, "ca")
+				}
+				servers[name] = config.Clusters[ctx.Cluster].Server
+			}
+			if !reflect.DeepEqual(servers, tt.wantServers) {
+				t.Errorf("got servers %v, want %v", servers, tt.wantServers)
+			}
+			if config.CurrentContext != tt.wantCurrent {
+				t.Errorf("got current context %q, want %q", config.CurrentContext, tt.wantCurrent)
+			}
+			var users []string
+			for name := range config.AuthInfos {
+				users = append(users, name)
+			}
+			sort.Strings(users)
+			if !reflect.DeepEqual(users, []string{tt.wantUser}) {
+				t.Errorf("got users %v, want %v", users, []string{tt.wantUser})
+			}
+		})
+	}
+}
+
+func TestKubeconfigContextName(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       types.NamespacedName
+		namespace string
+		want      string
+	}{
+		{"same namespace", types.NamespacedName{Namespace: "default", Name: "a"}, "default", "a"},
+		{"other namespace", types.NamespacedName{Namespace: "team", Name: "a"}, "default", "team_a"},
+		{"no current namespace", types.NamespacedName{Namespace: "team", Name: "a"}, "", "team_a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kubeconfigContextName(tt.key, tt.namespace); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
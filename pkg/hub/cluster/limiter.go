@@ -0,0 +1,180 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotinformers "github.com/smartxworks/kopilot/pkg/client/informers/externalversions/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/policy"
+)
+
+// RequestLimiter enforces the request limits of clusters on this hub replica.
+// Short-running and long-running requests are accounted separately, so that
+// open watches and exec sessions do not starve ordinary requests.
+type RequestLimiter struct {
+	limiters map[string]*clusterLimiter
+	mutex    sync.Mutex
+}
+
+// NewRequestLimiter returns a limiter which forgets the limiter of a cluster
+// once the cluster is deleted.
+func NewRequestLimiter(informer kopilotinformers.ClusterInformer) *RequestLimiter {
+	l := &RequestLimiter{
+		limiters: map[string]*clusterLimiter{},
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cluster, ok := obj.(*kopilotv1alpha1.Cluster); ok {
+				l.mutex.Lock()
+				delete(l.limiters, cluster.Namespace+"/"+cluster.Name)
+				l.mutex.Unlock()
+			}
+		},
+	})
+	return l
+}
+
+type requestLimits struct {
+	qps                    int32
+	burst                  int32
+	maxInflight            int32
+	maxInflightLongRunning int32
+}
+
+type clusterLimiter struct {
+	limits              requestLimits
+	rateLimiter         flowcontrol.RateLimiter
+	inflight            chan struct{}
+	inflightLongRunning chan struct{}
+}
+
+// Acquire admits a request to a cluster and returns a function to release it
+// once the request is done. A TooManyRequests error is returned instead if the
+// request exceeds the limits of the cluster.
+func (l *RequestLimiter) Acquire(cluster *kopilotv1alpha1.Cluster, longRunning bool) (func(), *apierrors.StatusError) {
+	cl := l.clusterLimiter(cluster)
+	if longRunning {
+		return acquireInflight(cl.inflightLongRunning, fmt.Sprintf("too many long-running requests to cluster %q", cluster.Namespace+"/"+cluster.Name))
+	}
+
+	if cl.rateLimiter != nil && !cl.rateLimiter.TryAccept() {
+		return nil, apierrors.NewTooManyRequests(fmt.Sprintf("request rate to cluster %q exceeded", cluster.Namespace+"/"+cluster.Name), 1)
+	}
+	return acquireInflight(cl.inflight, fmt.Sprintf("too many requests to cluster %q", cluster.Namespace+"/"+cluster.Name))
+}
+
+func acquireInflight(inflight chan struct{}, message string) (func(), *apierrors.StatusError) {
+	if inflight == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case inflight <- struct{}{}:
+		return func() { <-inflight }, nil
+	default:
+		return nil, apierrors.NewTooManyRequests(message, 1)
+	}
+}
+
+// clusterLimiter returns the limiter of a cluster, replacing it when the limits
+// of the cluster have changed. Requests in flight on a replaced limiter are
+// released against it, and do not count towards the new one.
+func (l *RequestLimiter) clusterLimiter(cluster *kopilotv1alpha1.Cluster) *clusterLimiter {
+	limits := effectiveLimits(cluster)
+	id := cluster.Namespace + "/" + cluster.Name
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if cl, ok := l.limiters[id]; ok && cl.limits == limits {
+		return cl
+	}
+
+	cl := &clusterLimiter{
+		limits: limits,
+	}
+	if limits.qps > 0 {
+		burst := limits.burst
+		if burst < limits.qps {
+			burst = limits.qps
+		}
+		cl.rateLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(limits.qps), int(burst))
+	}
+	if limits.maxInflight > 0 {
+		cl.inflight = make(chan struct{}, limits.maxInflight)
+	}
+	if limits.maxInflightLongRunning > 0 {
+		cl.inflightLongRunning = make(chan struct{}, limits.maxInflightLongRunning)
+	}
+	l.limiters[id] = cl
+	return cl
+}
+
+func effectiveLimits(cluster *kopilotv1alpha1.Cluster) requestLimits {
+	limits := requestLimits{
+		qps:                    int32(hub.C.ClusterQPS),
+		burst:                  int32(hub.C.ClusterBurst),
+		maxInflight:            int32(hub.C.ClusterMaxInflight),
+		maxInflightLongRunning: int32(hub.C.ClusterMaxInflightLongRunning),
+	}
+	if spec := cluster.Spec.Limits; spec != nil {
+		if spec.QPS != nil {
+			limits.qps = *spec.QPS
+		}
+		if spec.Burst != nil {
+			limits.burst = *spec.Burst
+		}
+		if spec.MaxInflight != nil {
+			limits.maxInflight = *spec.MaxInflight
+		}
+		if spec.MaxInflightLongRunning != nil {
+			limits.maxInflightLongRunning = *spec.MaxInflightLongRunning
+		}
+	}
+	return limits
+}
+
+var (
+	longRunningVerbs        = sets.NewString("watch", "proxy")
+	longRunningSubresources = sets.NewString("attach", "exec", "proxy", "log", "portforward")
+)
+
+// isLongRunning reports whether a member cluster request may stay open
+// indefinitely, by the same verbs and subresources as kube-apiserver's
+// BasicLongRunningRequestCheck.
+func isLongRunning(r *http.Request, path string) bool {
+	if httpstream.IsUpgradeRequest(r) {
+		return true
+	}
+
+	attrs := policy.NewAttributes(r.Method, path, r.URL.Query())
+	return longRunningVerbs.Has(attrs.Verb) || (attrs.IsResourceRequest && longRunningSubresources.Has(attrs.Subresource))
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestRequestLimiterAcquire(t *testing.T) {
+	tests := []struct {
+		name        string
+		limits      *kopilotv1alpha1.ClusterLimits
+		longRunning bool
+		requests    int
+		want        int
+	}{
+		{
+			name:     "default max inflight",
+			requests: 5,
+			want:     3,
+		},
+		{
+			name:     "max inflight of cluster",
+			limits:   &kopilotv1alpha1.ClusterLimits{MaxInflight: int32Ptr(1)},
+			requests: 5,
+			want:     1,
+		},
+		{
+			name:     "unlimited",
+			limits:   &kopilotv1alpha1.ClusterLimits{MaxInflight: int32Ptr(0)},
+			requests: 50,
+			want:     50,
+		},
+		{
+			name:     "rate within burst",
+			limits:   &kopilotv1alpha1.ClusterLimits{QPS: int32Ptr(1), Burst: int32Ptr(2), MaxInflight: int32Ptr(0)},
+			requests: 5,
+			want:     2,
+		},
+		{
+			name:     "burst below qps",
+			limits:   &kopilotv1alpha1.ClusterLimits{QPS: int32Ptr(4), Burst: int32Ptr(1), MaxInflight: int32Ptr(0)},
+			requests: 5,
+			want:     4,
+		},
+		{
+			name:        "long-running requests are limited separately",
+			limits:      &kopilotv1alpha1.ClusterLimits{QPS: int32Ptr(1), MaxInflight: int32Ptr(1), MaxInflightLongRunning: int32Ptr(2)},
+			longRunning: true,
+			requests:    5,
+			want:        2,
+		},
+		{
+			name:        "long-running requests unlimited by default",
+			longRunning: true,
+			requests:    5,
+			want:        5,
+		},
+	}
+	defer func(c hub.Config) {
+		hub.C = c
+	}(hub.C)
+	hub.C.ClusterQPS = 0
+	hub.C.ClusterBurst = 0
+	hub.C.ClusterMaxInflight = 3
+	hub.C.ClusterMaxInflightLongRunning = 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &RequestLimiter{
+				limiters: map[string]*clusterLimiter{},
+			}
+			cluster := &kopilotv1alpha1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sample"},
+			}
+			cluster.Spec.Limits = tt.limits
+
+			admitted := 0
+			for i := 0; i < tt.requests; i++ {
+				release, err := l.Acquire(cluster, tt.longRunning)
+				if err != nil {
+					if code := err.Status().Code; code != http.StatusTooManyRequests {
+						t.Errorf("got status %d, want %d", code, http.StatusTooManyRequests)
+					}
+					continue
+				}
+				admitted++
+				defer release()
+			}
+			if admitted != tt.want {
+				t.Errorf("admitted %d of %d requests, want %d", admitted, tt.requests, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLimiterReleaseAndChange(t *testing.T) {
+	defer func(c hub.Config) {
+		hub.C = c
+	}(hub.C)
+	hub.C.ClusterQPS = 0
+	hub.C.ClusterMaxInflight = 0
+	l := &RequestLimiter{
+		limiters: map[string]*clusterLimiter{},
+	}
+	cluster := &kopilotv1alpha1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sample"},
+	}
+	cluster.Spec.Limits = &kopilotv1alpha1.ClusterLimits{MaxInflight: int32Ptr(1)}
+
+	release, err := l.Acquire(cluster, false)
+	if err != nil {
+		t.Fatalf("first request: %s", err)
+	}
+	if _, err := l.Acquire(cluster, false); err == nil {
+		t.Fatal("second request admitted while the first is in flight")
+	}
+	release()
+	release, err = l.Acquire(cluster, false)
+	if err != nil {
+		t.Fatalf("request after release: %s", err)
+	}
+
+	// requests in flight do not count towards changed limits
+	cluster.Spec.Limits = &kopilotv1alpha1.ClusterLimits{MaxInflight: int32Ptr(2)}
+	if _, err := l.Acquire(cluster, false); err != nil {
+		t.Fatalf("request after raising the limit: %s", err)
+	}
+	release()
+}
+
+func TestIsLongRunning(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		want   bool
+	}{
+		{
+			name:   "list",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+		},
+		{
+			name:   "watch",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods?watch=true",
+			want:   true,
+		},
+		{
+			name:   "logs",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods/foo/log?follow=true",
+			want:   true,
+		},
+		{
+			name:   "exec upgrade",
+			method: "POST",
+			path:   "/api/v1/namespaces/default/pods/foo/exec?command=sh",
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "SPDY/3.1"},
+			want:   true,
+		},
+		{
+			name:   "pod named like a subresource",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods/exec",
+		},
+		{
+			name:   "non-resource URL ending like a subresource",
+			method: "GET",
+			path:   "/apis/example.com/v1/log",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := isLongRunning(r, r.URL.Path); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
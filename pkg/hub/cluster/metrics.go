@@ -0,0 +1,46 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tunnelCompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kopilot",
+		Subsystem: "hub",
+		Name:      "tunnel_compressed_bytes_total",
+		Help:      "Bytes of compressed responses received through tunnels, as transferred.",
+	}, []string{"namespace", "cluster", "algorithm"})
+	tunnelUncompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kopilot",
+		Subsystem: "hub",
+		Name:      "tunnel_uncompressed_bytes_total",
+		Help:      "Bytes of compressed responses received through tunnels, after decompression.",
+	}, []string{"namespace", "cluster", "algorithm"})
+	discoveryCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kopilot",
+		Subsystem: "hub",
+		Name:      "discovery_cache_requests_total",
+		Help:      "Discovery and OpenAPI requests to clusters by how the cache answered them: hit, revalidated or miss.",
+	}, []string{"namespace", "cluster", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(tunnelCompressedBytes, tunnelUncompressedBytes, discoveryCacheRequests)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"fmt"
+	"net/url"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/policy"
+)
+
+// checkPolicy returns the error a request of user to the apiserver of cluster
+// is rejected with, or nil if the policy of cluster allows it.
+func checkPolicy(cluster *kopilotv1alpha1.Cluster, user requestUser, method string, path string, query url.Values) *apierrors.StatusError {
+	p := cluster.Spec.Policy
+	if p == nil {
+		return nil
+	}
+
+	if err := policy.ValidatePath(path); err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	attrs := policy.NewAttributes(method, path, query)
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !policyRuleAppliesTo(rule, user) || !policy.FromClusterPolicyRule(rule).Matches(attrs) {
+			continue
+		}
+		if rule.Action == kopilotv1alpha1.PolicyActionAllow {
+			return nil
+		}
+		return policy.Forbidden(attrs, fmt.Sprintf("denied by rule #%d of the policy of cluster %q", i, cluster.Namespace+"/"+cluster.Name))
+	}
+	if p.DefaultAction == kopilotv1alpha1.PolicyActionDeny {
+		return policy.Forbidden(attrs, fmt.Sprintf("denied by default by the policy of cluster %q", cluster.Namespace+"/"+cluster.Name))
+	}
+	return nil
+}
+
+// policyRuleAppliesTo reports whether rule applies to user, which it does to
+// everyone if it names neither users nor groups.
+func policyRuleAppliesTo(rule *kopilotv1alpha1.ClusterPolicyRule, user requestUser) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	for _, name := range rule.Users {
+		if name == user.Name {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		for _, g := range user.Groups {
+			if group == g {
+				return true
+			}
+		}
+	}
+	return false
+}
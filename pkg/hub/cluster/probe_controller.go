@@ -0,0 +1,488 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/tools/record"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+	kopilotinformers "github.com/smartxworks/kopilot/pkg/client/informers/externalversions/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+// Labels set on Clusters from their inventory if the hub is started with
+// inventory-labels.
+var (
+	KubernetesVersionLabel      = fmt.Sprintf("%s/kubernetes-version", kopilotv1alpha1.SchemeGroupVersion.Group)
+	KubernetesMinorVersionLabel = fmt.Sprintf("%s/kubernetes-minor-version", kopilotv1alpha1.SchemeGroupVersion.Group)
+	ProviderLabel               = fmt.Sprintf("%s/provider", kopilotv1alpha1.SchemeGroupVersion.Group)
+	RegionLabel                 = fmt.Sprintf("%s/region", kopilotv1alpha1.SchemeGroupVersion.Group)
+)
+
+const (
+	probeNodesPageSize     = 500
+	maxProbeMessageSize    = 1024
+	nodeRegionLabel        = "topology.kubernetes.io/region"
+	nodeZoneLabel          = "topology.kubernetes.io/zone"
+	nodeArchitectureLabel  = "kubernetes.io/arch"
+	legacyNodeRegionLabel  = "failure-domain.beta.kubernetes.io/region"
+	legacyNodeZoneLabel    = "failure-domain.beta.kubernetes.io/zone"
+	legacyNodeArchitecture = "beta.kubernetes.io/arch"
+)
+
+// probeTimeRefreshIntervals is the number of probe intervals after which the
+// probe time is written even if nothing else in the status changed.
+const probeTimeRefreshIntervals = 5
+
+// ProbeController probes the member clusters connected to this hub through
+// their sessions, and reports their health and inventory in the status of
+// their Cluster. Optionally it labels Clusters after their inventory. Of the
+// hubs holding sessions to a cluster, only the one with the lowest ID probes
+// it, and clusters no hub holds sessions to are reported as not ready.
+type ProbeController struct {
+	client         clientset.Interface
+	lister         kopilotlisters.ClusterLister
+	sessionManager SessionManager
+	peerManager    PeerManager
+	recorder       record.EventRecorder
+}
+
+func NewProbeController(client clientset.Interface, informer kopilotinformers.ClusterInformer, sessionManager SessionManager, peerManager PeerManager, recorder record.EventRecorder) *ProbeController {
+	return &ProbeController{
+		client:         client,
+		lister:         informer.Lister(),
+		sessionManager: sessionManager,
+		peerManager:    peerManager,
+		recorder:       recorder,
+	}
+}
+
+func (c *ProbeController) Start(ctx context.Context) error {
+	if hub.C.ClusterProbeInterval <= 0 {
+		return nil
+	}
+	wait.UntilWithContext(ctx, c.probeAll, hub.C.ClusterProbeInterval)
+	return nil
+}
+
+func (c *ProbeController) probeAll(ctx context.Context) {
+	clusters, err := c.lister.List(labels.Everything())
+	if err != nil {
+		log.Printf("failed to list clusters: %s", err)
+		return
+	}
+	owned, held, leader := c.assignClusters(ctx)
+
+	workers := hub.C.ClusterProbeWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *kopilotv1alpha1.Cluster)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cluster := range queue {
+				var err error
+				if owned.Has(cluster.Namespace + "/" + cluster.Name) {
+					err = c.probe(ctx, cluster)
+				} else {
+					err = c.reportNoSession(ctx, cluster)
+				}
+				if err != nil {
+					log.Printf("failed to probe cluster %q: %s", cluster.Namespace+"/"+cluster.Name, err)
+				}
+			}
+		}()
+	}
+	for _, cluster := range clusters {
+		if cluster.Spec.Suspended {
+			continue
+		}
+		key := cluster.Namespace + "/" + cluster.Name
+		if !owned.Has(key) && (!leader || held.Has(key)) {
+			continue
+		}
+		queue <- cluster
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// assignClusters returns the clusters this hub probes, which are those it
+// holds sessions to and no peer with a lower ID does, and the clusters any hub
+// holds sessions to. Only the hub with the lowest ID is the leader, reporting
+// the clusters no hub holds sessions to as not ready. While some peers cannot
+// be asked, they are taken as holding no sessions, so a cluster may be probed
+// by more than one hub meanwhile, but no hub is the leader.
+func (c *ProbeController) assignClusters(ctx context.Context) (owned sets.String, held sets.String, leader bool) {
+	owned = sets.NewString(c.sessionManager.ListClusters()...)
+	held = sets.NewString(owned.UnsortedList()...)
+	if c.peerManager == nil {
+		return owned, held, true
+	}
+	peerSessions, err := c.peerManager.ListPeerSessions(ctx)
+	if err != nil {
+		log.Printf("failed to list sessions of peers: %s", err)
+	}
+	id := hub.ID()
+	leader = err == nil
+	for _, s := range peerSessions {
+		held.Insert(s.Clusters...)
+		if s.HubID < id {
+			owned.Delete(s.Clusters...)
+			leader = false
+		}
+	}
+	return owned, held, leader
+}
+
+// reportNoSession marks cluster as not ready, as no hub holds a session to
+// it to probe it through. Its inventory is left as last probed.
+func (c *ProbeController) reportNoSession(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	now := metav1.Now()
+	health := &kopilotv1alpha1.ClusterHealthStatus{
+		Message:       "no session to the member cluster",
+		LastProbeTime: &now,
+	}
+	return c.updateStatus(ctx, cluster, health, nil)
+}
+
+func (c *ProbeController) probe(ctx context.Context, cluster *kopilotv1alpha1.Cluster) error {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	conn, err := c.sessionManager.DialCluster(key)
+	if err != nil {
+		// the agents are connected to another hub or not connected at all
+		return nil
+	}
+	client := newClusterClient(c.sessionManager, key, conn)
+	defer client.CloseIdleConnections()
+
+	now := metav1.Now()
+	health := &kopilotv1alpha1.ClusterHealthStatus{
+		LastProbeTime: &now,
+	}
+	var inventory *kopilotv1alpha1.ClusterInventoryStatus
+	var nodesErr error
+
+	var info version.Info
+	if err := getFromCluster(ctx, client, "/version", &info); err != nil {
+		health.Message = fmt.Sprintf("failed to get version: %s", err)
+	} else {
+		health.Ready, health.Message = probeReadiness(ctx, client)
+		inventory = &kopilotv1alpha1.ClusterInventoryStatus{
+			KubernetesVersion: info.GitVersion,
+			Platform:          info.Platform,
+		}
+		if nodesErr = probeNodes(ctx, client, inventory); nodesErr != nil {
+			// keep the node part of the inventory we knew, rather than report a cluster without nodes
+			if old := cluster.Status.Inventory; old != nil {
+				copyNodeInventory(inventory, old)
+			}
+		}
+	}
+
+	if err := c.updateStatus(ctx, cluster, health, inventory); err != nil {
+		return err
+	}
+	if hub.C.InventoryLabels && inventory != nil {
+		if err := c.updateLabels(ctx, cluster, inventory); err != nil {
+			return err
+		}
+	}
+	if nodesErr != nil {
+		return fmt.Errorf("list nodes: %s", nodesErr)
+	}
+	return nil
+}
+
+func (c *ProbeController) updateStatus(ctx context.Context, cluster *kopilotv1alpha1.Cluster, health *kopilotv1alpha1.ClusterHealthStatus, inventory *kopilotv1alpha1.ClusterInventoryStatus) error {
+	health.LastTransitionTime = health.LastProbeTime
+	if old := cluster.Status.Health; old != nil && old.Ready == health.Ready {
+		health.LastTransitionTime = old.LastTransitionTime
+	} else if old != nil || !health.Ready {
+		if health.Ready {
+			c.recorder.Event(cluster, corev1.EventTypeNormal, "ClusterReady", "Member cluster is ready")
+		} else {
+			c.recorder.Eventf(cluster, corev1.EventTypeWarning, "ClusterNotReady", "Member cluster is not ready: %s", health.Message)
+		}
+	}
+
+	if inventory == nil {
+		inventory = cluster.Status.Inventory
+	} else if old := cluster.Status.Inventory; old != nil {
+		inventory.LastUpdateTime = old.LastUpdateTime
+		if !apiequality.Semantic.DeepEqual(inventory, old) {
+			inventory.LastUpdateTime = health.LastProbeTime
+		}
+	} else {
+		inventory.LastUpdateTime = health.LastProbeTime
+	}
+
+	// only refresh the probe time every few intervals if nothing else changed
+	if old := cluster.Status.Health; old != nil && old.Ready == health.Ready && old.Message == health.Message &&
+		old.LastProbeTime != nil && health.LastProbeTime.Sub(old.LastProbeTime.Time) < probeTimeRefreshIntervals*hub.C.ClusterProbeInterval &&
+		apiequality.Semantic.DeepEqual(inventory, cluster.Status.Inventory) {
+		return nil
+	}
+
+	cluster = cluster.DeepCopy()
+	cluster.Status.Health = health
+	cluster.Status.Inventory = inventory
+	if _, err := c.client.KopilotV1alpha1().Clusters(cluster.Namespace).UpdateStatus(ctx, cluster, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update status: %s", err)
+	}
+	return nil
+}
+
+// updateLabels sets the inventory labels of cluster, and removes those the
+// inventory no longer gives a single value for.
+func (c *ProbeController) updateLabels(ctx context.Context, cluster *kopilotv1alpha1.Cluster, inventory *kopilotv1alpha1.ClusterInventoryStatus) error {
+	desired := inventoryLabels(inventory)
+	patch := map[string]interface{}{}
+	for _, k := range []string{KubernetesVersionLabel, KubernetesMinorVersionLabel, ProviderLabel, RegionLabel} {
+		v, ok := desired[k]
+		old, hadOld := cluster.Labels[k]
+		switch {
+		case ok && (!hadOld || old != v):
+			patch[k] = v
+		case !ok && hadOld:
+			patch[k] = nil
+		}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": patch,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.client.KopilotV1alpha1().Clusters(cluster.Namespace).Patch(ctx, cluster.Name, types.MergePatchType, data, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("update labels: %s", err)
+	}
+	return nil
+}
+
+func inventoryLabels(inventory *kopilotv1alpha1.ClusterInventoryStatus) map[string]string {
+	l := map[string]string{}
+	if v, err := utilversion.ParseGeneric(inventory.KubernetesVersion); err == nil {
+		l[KubernetesVersionLabel] = fmt.Sprintf("v%d.%d.%d", v.Major(), v.Minor(), v.Patch())
+		l[KubernetesMinorVersionLabel] = fmt.Sprintf("v%d.%d", v.Major(), v.Minor())
+	}
+	// clusters spanning several providers or regions are not labelled with either
+	if len(inventory.Providers) == 1 {
+		l[ProviderLabel] = inventory.Providers[0]
+	}
+	if len(inventory.Regions) == 1 {
+		l[RegionLabel] = inventory.Regions[0]
+	}
+	for k, v := range l {
+		if len(validation.IsValidLabelValue(v)) > 0 {
+			delete(l, k)
+		}
+	}
+	return l
+}
+
+// probeReadiness asks the apiserver whether it is ready, falling back to its
+// health check if it predates readyz.
+func probeReadiness(ctx context.Context, client *http.Client) (bool, string) {
+	code, msg, err := getStatusFromCluster(ctx, client, "/readyz")
+	if err == nil && code == http.StatusNotFound {
+		code, msg, err = getStatusFromCluster(ctx, client, "/healthz")
+	}
+	if err != nil {
+		return false, fmt.Sprintf("failed to check readiness: %s", err)
+	}
+	if code != http.StatusOK {
+		return false, msg
+	}
+	return true, ""
+}
+
+func probeNodes(ctx context.Context, client *http.Client, inventory *kopilotv1alpha1.ClusterInventoryStatus) error {
+	capacity := corev1.ResourceList{}
+	allocatable := corev1.ResourceList{}
+	providers, regions, zones, architectures := sets.NewString(), sets.NewString(), sets.NewString(), sets.NewString()
+	var nodes, readyNodes int32
+
+	query := url.Values{"limit": {fmt.Sprint(probeNodesPageSize)}}
+	for {
+		var list corev1.NodeList
+		if err := getFromCluster(ctx, client, "/api/v1/nodes?"+query.Encode(), &list); err != nil {
+			return err
+		}
+		for _, node := range list.Items {
+			nodes++
+			for _, condition := range node.Status.Conditions {
+				if condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue {
+					readyNodes++
+				}
+			}
+			addResources(capacity, node.Status.Capacity)
+			addResources(allocatable, node.Status.Allocatable)
+			if i := strings.Index(node.Spec.ProviderID, "://"); i > 0 {
+				providers.Insert(node.Spec.ProviderID[:i])
+			}
+			insertLabel(regions, node.Labels, nodeRegionLabel, legacyNodeRegionLabel)
+			insertLabel(zones, node.Labels, nodeZoneLabel, legacyNodeZoneLabel)
+			insertLabel(architectures, node.Labels, nodeArchitectureLabel, legacyNodeArchitecture)
+		}
+		if list.Continue == "" {
+			break
+		}
+		query.Set("continue", list.Continue)
+	}
+
+	inventory.Nodes = nodes
+	inventory.ReadyNodes = readyNodes
+	if len(capacity) > 0 {
+		inventory.Capacity = capacity
+	}
+	if len(allocatable) > 0 {
+		inventory.Allocatable = allocatable
+	}
+	inventory.Providers = sortedOrNil(providers)
+	inventory.Regions = sortedOrNil(regions)
+	inventory.Zones = sortedOrNil(zones)
+	inventory.Architectures = sortedOrNil(architectures)
+	return nil
+}
+
+func copyNodeInventory(inventory *kopilotv1alpha1.ClusterInventoryStatus, old *kopilotv1alpha1.ClusterInventoryStatus) {
+	inventory.Nodes = old.Nodes
+	inventory.ReadyNodes = old.ReadyNodes
+	inventory.Capacity = old.Capacity
+	inventory.Allocatable = old.Allocatable
+	inventory.Providers = old.Providers
+	inventory.Regions = old.Regions
+	inventory.Zones = old.Zones
+	inventory.Architectures = old.Architectures
+}
+
+func addResources(total corev1.ResourceList, resources corev1.ResourceList) {
+	for name, quantity := range resources {
+		sum := total[name]
+		sum.Add(quantity)
+		total[name] = sum
+	}
+}
+
+func insertLabel(values sets.String, labels map[string]string, keys ...string) {
+	for _, k := range keys {
+		if v := labels[k]; v != "" {
+			values.Insert(v)
+			return
+		}
+	}
+}
+
+func sortedOrNil(values sets.String) []string {
+	if values.Len() == 0 {
+		return nil
+	}
+	return values.List()
+}
+
+// newClusterClient returns a client sending requests to the apiserver of a
+// cluster, starting on conn and dialing further streams when needed.
+func newClusterClient(sessionManager SessionManager, key types.NamespacedName, conn net.Conn) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				if conn != nil {
+					c := conn
+					conn = nil
+					return c, nil
+				}
+				return sessionManager.DialCluster(key)
+			},
+			MaxIdleConnsPerHost: 1,
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+func getFromCluster(ctx context.Context, client *http.Client, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://apiserver"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeMessageSize))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func getStatusFromCluster(ctx context.Context, client *http.Client, path string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://apiserver"+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeMessageSize))
+	return resp.StatusCode, strings.TrimSpace(string(msg)), nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+// StartPublicServer serves the connect and agent subresources on
+// PublicBindAddr, so that agents may reach the hub without kube-apiserver,
+// for example through an Ingress or a LoadBalancer. Paths are those of the
+// subresources, optionally below the path of the public URL. Agents connect
+// over any transport there.
+func StartPublicServer(ctx context.Context, lister kopilotlisters.ClusterLister, sessionManager SessionManager) error {
+	if hub.C.PublicBindAddr == "" {
+		return nil
+	}
+
+	publicURL, err := hub.PublicURL()
+	if err != nil {
+		return fmt.Errorf("parse public URL: %s", err)
+	}
+	var prefix string
+	if publicURL != nil {
+		prefix = publicURL.Path
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(hub.C.PublicCertDir, "tls.crt"), filepath.Join(hub.C.PublicCertDir, "tls.key"))
+	if err != nil {
+		return fmt.Errorf("load public cert: %s", err)
+	}
+
+	server := &http.Server{
+		Addr:    hub.C.PublicBindAddr,
+		Handler: newPublicHandler(lister, sessionManager, prefix),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("error shutting down the public server: %s", err)
+		}
+		close(idleConnsClosed)
+	}()
+
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	<-idleConnsClosed
+	return nil
+}
+
+// newPublicHandler serves the connect and agent subresources below prefix.
+func newPublicHandler(lister kopilotlisters.ClusterLister, sessionManager SessionManager, prefix string) http.Handler {
+	keyPlaceholder := types.NamespacedName{
+		Namespace: "{namespace}",
+		Name:      "{name}",
+	}
+	agentSubresource := NewAgentSubresource(lister)
+	r := mux.NewRouter()
+	r.Path(NewConnectSubresource(nil, nil).Path(keyPlaceholder)).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewConnectHandler(lister, sessionManager, pathKey(r), requestTransport(r)).ServeHTTP(w, r)
+	})
+	r.Path(agentSubresource.Path(keyPlaceholder)).Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, err := agentSubresource.Connect(r.Context(), pathKey(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	return connectPathHandler(stripPrefixHandler(prefix, r))
+}
+
+func pathKey(r *http.Request) types.NamespacedName {
+	vars := mux.Vars(r)
+	return types.NamespacedName{
+		Namespace: vars["namespace"],
+		Name:      vars["name"],
+	}
+}
+
+// stripPrefixHandler removes prefix from request paths, unless an Ingress
+// in front of the hub removed it already.
+func stripPrefixHandler(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path := strings.TrimPrefix(r.URL.Path, prefix); path != r.URL.Path && strings.HasPrefix(path, "/") {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
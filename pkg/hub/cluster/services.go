@@ -0,0 +1,79 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	subresourceserver "github.com/smartxworks/kubernetes-subresource-server-runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// NewServicesSubresource proxies requests on services/{service}/proxy/{path}
+// to the services exposed by a Cluster.
+func NewServicesSubresource(lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter) *subresourceserver.Subresource {
+	return &subresourceserver.Subresource{
+		NamespaceScoped:      true,
+		GroupVersionResource: GroupVersionResource,
+		Name:                 "services",
+		Route: func(ctx context.Context, key types.NamespacedName, path string) (http.Handler, error) {
+			segs := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+			if len(segs) < 2 || segs[0] == "" || segs[1] != "proxy" {
+				return http.NotFoundHandler(), nil
+			}
+
+			subpath := "/"
+			if len(segs) == 3 {
+				subpath += segs[2]
+			}
+			return NewProxyHandler(lister, sessionManager, peerManager, limiter, nil, key, tunnel.ServiceTarget(segs[0]), subpath), nil
+		},
+	}
+}
+
+func findService(cluster *kopilotv1alpha1.Cluster, name string) *kopilotv1alpha1.ClusterService {
+	for i := range cluster.Spec.Services {
+		if cluster.Spec.Services[i].Name == name {
+			return &cluster.Spec.Services[i]
+		}
+	}
+	return nil
+}
+
+// tunnelServices returns the services agents of cluster may proxy to.
+func tunnelServices(cluster *kopilotv1alpha1.Cluster) []tunnel.Service {
+	services := []tunnel.Service{}
+	for _, s := range cluster.Spec.Services {
+		service := tunnel.Service{
+			Name: s.Name,
+			URL:  s.URL,
+		}
+		if s.TLS != nil {
+			service.CAData = s.TLS.CABundle
+			service.ServerName = s.TLS.ServerName
+			service.InsecureSkipVerify = s.TLS.InsecureSkipVerify
+		}
+		services = append(services, service)
+	}
+	return services
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+)
+
+// sessionOverrides returns the session config set in cluster, which
+// overrides the flags of both hub and agents.
+func sessionOverrides(cluster *kopilotv1alpha1.Cluster) tunnel.SessionConfig {
+	var overrides tunnel.SessionConfig
+	spec := cluster.Spec.Session
+	if spec == nil {
+		return overrides
+	}
+	if spec.KeepAliveInterval != nil {
+		overrides.KeepAliveInterval = spec.KeepAliveInterval.Duration
+	}
+	if spec.ConnectionWriteTimeout != nil {
+		overrides.ConnectionWriteTimeout = spec.ConnectionWriteTimeout.Duration
+	}
+	if spec.MaxStreamWindowSize != nil {
+		overrides.MaxStreamWindowSize = int(*spec.MaxStreamWindowSize)
+	}
+	if spec.AcceptBacklog != nil {
+		overrides.AcceptBacklog = int(*spec.AcceptBacklog)
+	}
+	if spec.StreamOpenTimeout != nil {
+		overrides.StreamOpenTimeout = spec.StreamOpenTimeout.Duration
+	}
+	return overrides
+}
@@ -21,62 +21,260 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"k8s.io/apimachinery/pkg/types"
+
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
 )
 
 type SessionManager interface {
-	AddClusterSession(key types.NamespacedName, sess *yamux.Session)
-	DialCluster(key types.NamespacedName) (net.Conn, error)
+	// AddClusterSession adds a session of a cluster, on which streams are opened within streamOpenTimeout.
+	// It fails if the cluster is gone, suspended or no longer has token by the time the session is added.
+	AddClusterSession(key types.NamespacedName, token string, agent *tunnel.AgentHello, features []string, streamOpenTimeout time.Duration, sess *yamux.Session) error
+	// DialCluster opens a stream to a cluster on a session which has all the given features enabled.
+	DialCluster(key types.NamespacedName, features ...string) (net.Conn, error)
+	// DialClusterSessions opens a stream on every session of a cluster which has all the given features enabled.
+	DialClusterSessions(key types.NamespacedName, features ...string) []net.Conn
+	// CloseClusterSessions closes all sessions of a cluster and returns how many were closed.
+	CloseClusterSessions(key types.NamespacedName) int
+	// RevokeClusterSessions closes the sessions of a cluster that were not authenticated with token
+	// and returns how many were closed.
+	RevokeClusterSessions(key types.NamespacedName, token string) int
+	// ListClusters returns the clusters with at least one session, as namespace/name.
+	ListClusters() []string
 }
 
-func NewSessionManager() SessionManager {
+func NewSessionManager(lister kopilotlisters.ClusterLister) SessionManager {
 	return &sessionManager{
-		sessionLists: map[string][]*yamux.Session{},
+		lister:       lister,
+		sessionLists: map[string][]*clusterSession{},
 	}
 }
 
+// clusterSession is a session of an agent along with the token it connected
+// with, what the agent reported in the handshake and the features enabled.
+type clusterSession struct {
+	*yamux.Session
+	token             string
+	agent             *tunnel.AgentHello
+	features          []string
+	streamOpenTimeout time.Duration
+}
+
+func (s *clusterSession) Open() (net.Conn, error) {
+	stream, err := tunnel.OpenStream(s.Session, s.streamOpenTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *clusterSession) hasFeatures(features []string) bool {
+	for _, f := range features {
+		found := false
+		for _, enabled := range s.features {
+			if f == enabled {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 type sessionManager struct {
-	sessionLists map[string][]*yamux.Session
+	lister       kopilotlisters.ClusterLister
+	sessionLists map[string][]*clusterSession
 	mutex        sync.Mutex
 }
 
-func (m *sessionManager) AddClusterSession(key types.NamespacedName, s *yamux.Session) {
+func (m *sessionManager) AddClusterSession(key types.NamespacedName, token string, agent *tunnel.AgentHello, features []string, streamOpenTimeout time.Duration, s *yamux.Session) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	// The cluster may have changed since the agent was authenticated. The
+	// informer updates its cache before the session controller closes
+	// sessions, which waits for the mutex, so a session added here is closed
+	// by any later change.
+	cluster, err := m.lister.Clusters(key.Namespace).Get(key.Name)
+	if err != nil {
+		return fmt.Errorf("get cluster: %s", err)
+	}
+	if cluster.Spec.Suspended {
+		return fmt.Errorf("cluster is suspended")
+	}
+	if cluster.Token != token {
+		return fmt.Errorf("token of cluster has changed")
+	}
+
 	id := key.String()
 	ss := m.sessionLists[id]
 	if ss == nil {
-		ss = []*yamux.Session{}
+		ss = []*clusterSession{}
 	}
-	ss = append(ss, s)
+	cs := &clusterSession{
+		Session:           s,
+		token:             token,
+		agent:             agent,
+		features:          features,
+		streamOpenTimeout: streamOpenTimeout,
+	}
+	ss = append(ss, cs)
 	m.sessionLists[id] = ss
+
+	go func() {
+		<-s.CloseChan()
+		m.removeClusterSessions(key, func(s *clusterSession) bool {
+			return s == cs
+		})
+	}()
+	return nil
 }
 
-func (m *sessionManager) DialCluster(key types.NamespacedName) (net.Conn, error) {
+func (m *sessionManager) DialCluster(key types.NamespacedName, features ...string) (net.Conn, error) {
+	id := key.String()
+	tried := map[*clusterSession]bool{}
+	var lastErr error
+	for {
+		s, idx, err := m.pickSession(id, features, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("failed to dial cluster %q with any session: %s", id, lastErr)
+			}
+			return nil, err
+		}
+
+		// streams are opened outside the mutex, so a slow session holds up only the dials waiting for it
+		log.Printf("dialing cluster %q with session #%d", id, idx)
+		conn, err := s.Open()
+		if err == nil {
+			return conn, nil
+		}
+		tried[s] = true
+		lastErr = err
+		if isSessionError(s, err) {
+			log.Printf("removing session #%d of cluster %q due to dial error: %s", idx, id, err)
+			s.Close()
+			m.removeClusterSessions(key, func(other *clusterSession) bool {
+				return other == s
+			})
+			continue
+		}
+		log.Printf("failed to dial cluster %q with session #%d: %s", id, idx, err)
+	}
+}
+
+// pickSession returns a random session of cluster id not tried yet which has
+// all of features enabled, along with its index.
+func (m *sessionManager) pickSession(id string, features []string, tried map[*clusterSession]bool) (*clusterSession, int, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	id := key.String()
 	ss := m.sessionLists[id]
-	for {
-		if len(ss) == 0 {
-			return nil, fmt.Errorf("no session found for cluster %q", id)
+	var candidates []int
+	for i, s := range ss {
+		if s.hasFeatures(features) && !tried[s] {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		if len(ss) > 0 && len(features) > 0 {
+			return nil, 0, fmt.Errorf("no session of cluster %q supports features %v", id, features)
 		}
+		return nil, 0, fmt.Errorf("no session found for cluster %q", id)
+	}
+	idx := candidates[rand.Intn(len(candidates))]
+	return ss[idx], idx, nil
+}
 
-		idx := rand.Intn(len(ss))
-		log.Printf("dialing cluster %q with session #%d", id, idx)
-		conn, err := ss[idx].Open()
+// isSessionError reports whether err opening a stream on s means that s is
+// broken, rather than that the stream alone failed, for example by timing
+// out while the agent is busy.
+func isSessionError(s *clusterSession, err error) bool {
+	return s.IsClosed() || err == yamux.ErrSessionShutdown || err == yamux.ErrConnectionWriteTimeout || err == yamux.ErrRemoteGoAway
+}
+
+func (m *sessionManager) DialClusterSessions(key types.NamespacedName, features ...string) []net.Conn {
+	m.mutex.Lock()
+	var ss []*clusterSession
+	for _, s := range m.sessionLists[key.String()] {
+		if s.hasFeatures(features) {
+			ss = append(ss, s)
+		}
+	}
+	m.mutex.Unlock()
+
+	var conns []net.Conn
+	for i, s := range ss {
+		conn, err := s.Open()
 		if err != nil {
-			log.Printf("removing session #%d of cluster %q due to dial error: %s", idx, id, err)
-			ss[idx].Close()
-			ss = append(ss[:idx], ss[idx+1:]...)
-			m.sessionLists[id] = ss
+			log.Printf("failed to dial cluster %q with session #%d: %s", key, i, err)
 			continue
 		}
-		return conn, nil
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (m *sessionManager) ListClusters() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var ids []string
+	for id, ss := range m.sessionLists {
+		if len(ss) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (m *sessionManager) CloseClusterSessions(key types.NamespacedName) int {
+	return m.closeClusterSessions(key, func(s *clusterSession) bool {
+		return true
+	})
+}
+
+func (m *sessionManager) RevokeClusterSessions(key types.NamespacedName, token string) int {
+	return m.closeClusterSessions(key, func(s *clusterSession) bool {
+		return s.token != token
+	})
+}
+
+func (m *sessionManager) closeClusterSessions(key types.NamespacedName, match func(s *clusterSession) bool) int {
+	removed := m.removeClusterSessions(key, match)
+	for _, s := range removed {
+		s.Close()
+	}
+	return len(removed)
+}
+
+func (m *sessionManager) removeClusterSessions(key types.NamespacedName, match func(s *clusterSession) bool) []*clusterSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := key.String()
+	var kept, removed []*clusterSession
+	for _, s := range m.sessionLists[id] {
+		if match(s) {
+			removed = append(removed, s)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		delete(m.sessionLists, id)
+	} else {
+		m.sessionLists[id] = kept
 	}
+	return removed
 }
@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
+)
+
+func TestDialCluster(t *testing.T) {
+	tests := []struct {
+		name string
+		// session is the state of the only session of the cluster, if any:
+		// "ready", "busy" with streams the agent never accepts, or "closed"
+		session  string
+		wantErr  bool
+		wantKept bool
+	}{
+		{
+			name:    "no session",
+			wantErr: true,
+		},
+		{
+			name:     "ready session",
+			session:  "ready",
+			wantKept: true,
+		},
+		{
+			name:     "stream timing out keeps the session",
+			session:  "busy",
+			wantErr:  true,
+			wantKept: true,
+		},
+		{
+			name:    "closed session is removed",
+			session: "closed",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := types.NamespacedName{Namespace: "default", Name: "sample"}
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			indexer.Add(&kopilotv1alpha1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+				Token:      "token",
+			})
+			m := NewSessionManager(kopilotlisters.NewClusterLister(indexer))
+
+			if tt.session != "" {
+				hubConn, agentConn := net.Pipe()
+				config := yamux.DefaultConfig()
+				config.EnableKeepAlive = false
+				config.LogOutput = ioutil.Discard
+				config.AcceptBacklog = 1
+				sess, err := yamux.Client(hubConn, config)
+				if err != nil {
+					t.Fatalf("creating session: %s", err)
+				}
+				defer sess.Close()
+				agentSess, err := yamux.Server(agentConn, config)
+				if err != nil {
+					t.Fatalf("creating agent session: %s", err)
+				}
+				defer agentSess.Close()
+				switch tt.session {
+				case "ready":
+					go func() {
+						for {
+							if _, err := agentSess.Accept(); err != nil {
+								return
+							}
+						}
+					}()
+				case "busy":
+					// fill the backlog of unacknowledged streams
+					if _, err := sess.OpenStream(); err != nil {
+						t.Fatalf("opening stream: %s", err)
+					}
+				}
+				if err := m.AddClusterSession(key, "token", nil, nil, 100*time.Millisecond, sess); err != nil {
+					t.Fatalf("adding session: %s", err)
+				}
+				if tt.session == "closed" {
+					sess.Close()
+				}
+			}
+
+			conn, err := m.DialCluster(key)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Error("got no error, want one")
+				}
+			} else if err != nil {
+				t.Errorf("got error: %s", err)
+			} else {
+				conn.Close()
+			}
+			if kept := len(m.ListClusters()) > 0; kept != tt.wantKept {
+				t.Errorf("got session kept %t, want %t", kept, tt.wantKept)
+			}
+		})
+	}
+}
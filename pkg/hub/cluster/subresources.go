@@ -19,24 +19,35 @@ package cluster
 import (
 	"context"
 	_ "embed"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"text/template"
 
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 	subresourceserver "github.com/smartxworks/kubernetes-subresource-server-runtime"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 
 	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
-	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
 	"github.com/smartxworks/kopilot/pkg/hub"
+	"github.com/smartxworks/kopilot/pkg/policy"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
+	"github.com/smartxworks/kopilot/pkg/version"
 )
 
 //+kubebuilder:rbac:groups=kopilot.smartx.com,resources=clusters,verbs=get;list;watch;create;update;patch;delete
@@ -52,7 +63,7 @@ var GroupVersionResource = schema.GroupVersionResource{
 //go:embed kopilot-agent.yaml
 var AgentYAMLTemplate string
 
-func NewAgentSubresource(client clientset.Interface) *subresourceserver.Subresource {
+func NewAgentSubresource(lister kopilotlisters.ClusterLister) *subresourceserver.Subresource {
 	return &subresourceserver.Subresource{
 		NamespaceScoped:      true,
 		GroupVersionResource: GroupVersionResource,
@@ -60,7 +71,7 @@ func NewAgentSubresource(client clientset.Interface) *subresourceserver.Subresou
 		ConnectMethods:       []string{http.MethodGet},
 		Connect: func(ctx context.Context, key types.NamespacedName) (http.Handler, error) {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				cluster, err := client.KopilotV1alpha1().Clusters(key.Namespace).Get(r.Context(), key.Name, metav1.GetOptions{})
+				cluster, err := lister.Clusters(key.Namespace).Get(key.Name)
 				if err != nil {
 					if apierrors.IsNotFound(err) {
 						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -76,12 +87,22 @@ func NewAgentSubresource(client clientset.Interface) *subresourceserver.Subresou
 					return
 				}
 
-				connectSubresource := NewConnectSubresource(nil, nil)
-				connectPath := connectSubresource.Path(key)
+				transport, connectURL, err := agentConnectURL(cluster)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				caData, err := agentCAData()
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to load hub CA: %s", err), http.StatusInternalServerError)
+					return
+				}
 				tmpl := template.Must(template.New("kopilot-agent.yaml").Parse(AgentYAMLTemplate))
 				data := map[string]string{
-					"imageName":  hub.C.AgentImage,
-					"connectURL": fmt.Sprintf("wss://%s%s?token=%s", hub.C.PublicAddr, connectPath, token),
+					"imageName":  agentImage(cluster),
+					"connectURL": connectURL,
+					"transport":  transport,
+					"caData":     base64.StdEncoding.EncodeToString(caData),
 				}
 				if err := tmpl.Execute(w, data); err != nil {
 					panic(err)
@@ -91,70 +112,245 @@ func NewAgentSubresource(client clientset.Interface) *subresourceserver.Subresou
 	}
 }
 
-func NewConnectSubresource(client clientset.Interface, sessionManager SessionManager) *subresourceserver.Subresource {
+// agentConnectURL returns the transport and connect URL agents of cluster
+// use. Agents connect to the public listener if the public address of the hub
+// is its URL, and through kube-apiserver otherwise.
+func agentConnectURL(cluster *kopilotv1alpha1.Cluster) (string, string, error) {
+	key := types.NamespacedName{
+		Namespace: cluster.Namespace,
+		Name:      cluster.Name,
+	}
+	transport := tunnel.TransportWebSocket
+	switch cluster.Spec.Transport {
+	case kopilotv1alpha1.ClusterTransportHTTP2:
+		transport = tunnel.TransportHTTP2
+	case kopilotv1alpha1.ClusterTransportTLS:
+		transport = tunnel.TransportTLS
+	}
+
+	publicURL, err := hub.PublicURL()
+	if err != nil {
+		return "", "", fmt.Errorf("invalid public URL: %s", err)
+	}
+	if publicURL == nil {
+		if transport != tunnel.TransportWebSocket {
+			return "", "", fmt.Errorf("transport %s requires the public-addr of the hub to be the URL of its public listener", cluster.Spec.Transport)
+		}
+		publicURL = &url.URL{
+			Scheme: "https",
+			Host:   hub.C.PublicAddr,
+		}
+	}
+
+	connectURL := *publicURL
+	if transport == tunnel.TransportWebSocket {
+		connectURL.Scheme = "wss"
+	}
+	connectURL.Path += NewConnectSubresource(nil, nil).Path(key)
+	connectURL.RawQuery = url.Values{"token": []string{cluster.Token}}.Encode()
+	return transport, connectURL.String(), nil
+}
+
+// agentCAData returns the CA certificates agents verify the hub with: those of
+// the public listener if agents connect there, and those of kube-apiserver
+// otherwise. It returns nil if agents are to verify the hub with their system
+// roots.
+func agentCAData() ([]byte, error) {
+	publicURL, err := hub.PublicURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid public URL: %s", err)
+	}
+	file := hub.C.APIServerCAFile
+	if publicURL != nil {
+		file = hub.C.PublicCAFile
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(file)
+}
+
+func NewConnectSubresource(lister kopilotlisters.ClusterLister, sessionManager SessionManager) *subresourceserver.Subresource {
 	return &subresourceserver.Subresource{
 		NamespaceScoped:      true,
 		GroupVersionResource: GroupVersionResource,
 		Name:                 "connect",
 		ConnectMethods:       []string{http.MethodGet},
 		Connect: func(ctx context.Context, key types.NamespacedName) (http.Handler, error) {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				cluster, err := client.KopilotV1alpha1().Clusters(key.Namespace).Get(r.Context(), key.Name, metav1.GetOptions{})
-				if err != nil {
-					if apierrors.IsNotFound(err) {
-						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-						return
-					}
-					http.Error(w, fmt.Sprintf("failed to get cluster: %s", err), http.StatusInternalServerError)
-					return
-				}
+			return NewConnectHandler(lister, sessionManager, key, tunnel.WebSocketTransport{AllowRaw: hub.C.AllowRawWebSocket}), nil
+		},
+	}
+}
 
-				token := r.URL.Query().Get("token")
-				if token != cluster.Token {
-					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-					return
-				}
+// requestTransport returns the transport an agent connecting directly to the
+// hub asked for by its connect request: HTTP/2 CONNECT requests stream the
+// session, WebSocket upgrades carry it in messages, and other requests take
+// over their TLS connection.
+func requestTransport(r *http.Request) tunnel.Transport {
+	switch {
+	case r.Method == http.MethodConnect:
+		return tunnel.HTTP2Transport{}
+	case websocket.IsWebSocketUpgrade(r):
+		return tunnel.WebSocketTransport{AllowRaw: hub.C.AllowRawWebSocket}
+	default:
+		return tunnel.TLSTransport{}
+	}
+}
 
-				upgrader := websocket.Upgrader{
-					ReadBufferSize:  1024,
-					WriteBufferSize: 1024,
+// connectPathHandler routes HTTP/2 CONNECT requests, which have no path of
+// their own, by the path they carry in tunnel.ConnectPathHeader.
+func connectPathHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			u, err := url.ParseRequestURI(r.Header.Get(tunnel.ConnectPathHeader))
+			if err != nil {
+				http.Error(w, "invalid connect path", http.StatusBadRequest)
+				return
+			}
+			r.URL.Path = u.Path
+			r.URL.RawPath = u.RawPath
+			r.URL.RawQuery = u.RawQuery
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// NewConnectHandler accepts agents of a cluster connecting over transport.
+func NewConnectHandler(lister kopilotlisters.ClusterLister, sessionManager SessionManager, key types.NamespacedName, transport tunnel.Transport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cluster, err := lister.Clusters(key.Namespace).Get(key.Name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("failed to get cluster: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if token != cluster.Token {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if cluster.Spec.Suspended {
+			http.Error(w, fmt.Sprintf("cluster %q is suspended", key), http.StatusForbidden)
+			return
+		}
+
+		protocolVersion, err := tunnel.ParseProtocolVersion(r.Header.Get(tunnel.ProtocolVersionHeader))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid protocol version: %s", err), http.StatusBadRequest)
+			return
+		}
+		if protocolVersion < hub.C.MinAgentProtocolVersion || protocolVersion > tunnel.ProtocolVersion {
+			http.Error(w, fmt.Sprintf("agent protocol version %d is not supported by hub %s, which supports versions %d to %d",
+				protocolVersion, version.Version, hub.C.MinAgentProtocolVersion, tunnel.ProtocolVersion), http.StatusBadRequest)
+			return
+		}
+
+		overrides := sessionOverrides(cluster)
+		sessionConfig := hub.C.Session.Merge(overrides)
+		yamuxConfig, err := sessionConfig.YamuxConfig()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid session config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		responseHeader := http.Header{}
+		if overrides != (tunnel.SessionConfig{}) {
+			responseHeader.Set(tunnel.SessionConfigHeader, tunnel.EncodeSessionConfig(overrides))
+		}
+
+		conn, err := transport.Accept(w, r, responseHeader)
+		if err != nil {
+			log.Printf("failed to accept agent of cluster %q: %s", key, err)
+			return
+		}
+		// some transports require this handler to keep running for as long as the session
+		defer tunnel.WaitClosed(conn)
+
+		sess, err := yamux.Server(conn, yamuxConfig)
+		if err != nil {
+			log.Printf("failed to multiplex channel: %s", err)
+			conn.Close()
+			return
+		}
+
+		agentHello := &tunnel.AgentHello{
+			Version:         r.Header.Get(tunnel.AgentVersionHeader),
+			ProtocolVersion: protocolVersion,
+		}
+		var features []string
+		reverseTunnel := false
+		if protocolVersion > 0 {
+			hello, hubHello, err := tunnel.AcceptHandshake(sess, func(hello *tunnel.AgentHello) (*tunnel.HubHello, error) {
+				if hello.ProtocolVersion != protocolVersion {
+					return nil, fmt.Errorf("protocol version %d does not match version %d of the connect request", hello.ProtocolVersion, protocolVersion)
 				}
-				conn, err := upgrader.Upgrade(w, r, nil)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("failed to upgrade to WebSocket: %s", err), http.StatusInternalServerError)
-					return
+				hubHello := &tunnel.HubHello{
+					Version:         version.Version,
+					ProtocolVersion: protocolVersion,
+					HubID:           hub.ID(),
+					Features:        tunnel.CommonFeatures(hello.Features),
 				}
-
-				sess, err := yamux.Server(conn.UnderlyingConn(), nil)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("failed to multiplex channel: %s", err), http.StatusInternalServerError)
-					return
+				if hubHello.HasFeature(tunnel.FeatureServiceProxy) {
+					hubHello.Services = tunnelServices(cluster)
+				}
+				if hubHello.HasFeature(tunnel.FeatureTCPForward) {
+					hubHello.Endpoints = tunnelEndpoints(cluster)
 				}
+				if hubHello.HasFeature(tunnel.FeatureReverseTunnel) {
+					hubHello.HostServices = tunnelHostServices(cluster)
+				}
+				return hubHello, nil
+			})
+			if err != nil {
+				log.Printf("handshake with agent of cluster %q failed: %s", key, err)
+				sess.Close()
+				return
+			}
+			agentHello = hello
+			features = hubHello.Features
+			reverseTunnel = hubHello.HasFeature(tunnel.FeatureReverseTunnel)
+		}
 
-				sessionManager.AddClusterSession(key, sess)
-			}), nil
-		},
-	}
+		log.Printf("agent %s of cluster %q connected with protocol version %d, features %v, cluster UID %q and Kubernetes %s",
+			agentHello.Version, key, agentHello.ProtocolVersion, features, agentHello.ClusterUID, agentHello.KubernetesVersion)
+		log.Printf("session of cluster %q uses %s", key, sessionConfig)
+		if err := sessionManager.AddClusterSession(key, cluster.Token, agentHello, features, sessionConfig.StreamOpenTimeout, sess); err != nil {
+			log.Printf("rejecting session of cluster %q: %s", key, err)
+			sess.Close()
+			return
+		}
+		if reverseTunnel {
+			go serveHostServices(lister, key, sess)
+		}
+	})
 }
 
-func NewProxySubresource(client clientset.Interface, sessionManager SessionManager, peerManager PeerManager) *subresourceserver.Subresource {
+func NewProxySubresource(lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter, cache *DiscoveryCache) *subresourceserver.Subresource {
 	return &subresourceserver.Subresource{
 		NamespaceScoped:      true,
 		GroupVersionResource: GroupVersionResource,
 		Name:                 "proxy",
 		ConnectMethods:       []string{http.MethodGet},
 		Connect: func(ctx context.Context, key types.NamespacedName) (http.Handler, error) {
-			return NewProxyHandler(client, sessionManager, peerManager, key, ""), nil
+			return NewProxyHandler(lister, sessionManager, peerManager, limiter, cache, key, "", ""), nil
 		},
 		Route: func(ctx context.Context, key types.NamespacedName, path string) (http.Handler, error) {
-			return NewProxyHandler(client, sessionManager, peerManager, key, path), nil
+			return NewProxyHandler(lister, sessionManager, peerManager, limiter, cache, key, "", path), nil
 		},
 	}
 }
 
-func NewProxyHandler(client clientset.Interface, sessionManager SessionManager, peerManager PeerManager, key types.NamespacedName, subpath string) http.Handler {
+// NewProxyHandler proxies requests to tunnelTarget in a cluster, which is either the
+// apiserver if empty, or a service or endpoint exposed by the Cluster. Discovery
+// and OpenAPI documents of the apiserver are served from cache if it is not nil.
+func NewProxyHandler(lister kopilotlisters.ClusterLister, sessionManager SessionManager, peerManager PeerManager, limiter *RequestLimiter, cache *DiscoveryCache, key types.NamespacedName, tunnelTarget string, subpath string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := client.KopilotV1alpha1().Clusters(key.Namespace).Get(r.Context(), key.Name, metav1.GetOptions{}); err != nil {
+		cluster, err := lister.Clusters(key.Namespace).Get(key.Name)
+		if err != nil {
 			if apierrors.IsNotFound(err) {
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 				return
@@ -163,21 +359,134 @@ func NewProxyHandler(client clientset.Interface, sessionManager SessionManager,
 			return
 		}
 
+		if cluster.Spec.Suspended {
+			policy.WriteStatusError(w, apierrors.NewServiceUnavailable(fmt.Sprintf("cluster %q is suspended", key)))
+			return
+		}
+
+		if tunnelTarget == "" {
+			if err := checkPolicy(cluster, userFromRequest(r), r.Method, subpath, r.URL.Query()); err != nil {
+				policy.WriteStatusError(w, err)
+				return
+			}
+		}
+
+		var cacheKey *discoveryCacheKey
+		var staleEntry *discoveryCacheEntry
+		clientETag := r.Header.Get("If-None-Match")
+		if cache != nil && hub.C.DiscoveryCacheTTL > 0 && tunnelTarget == "" && r.Method == http.MethodGet && isDiscoveryPath(subpath) {
+			k := newDiscoveryCacheKey(key, subpath, r)
+			if entry := cache.get(k); entry != nil {
+				if entry.fresh() {
+					discoveryCacheRequests.WithLabelValues(key.Namespace, key.Name, "hit").Inc()
+					entry.ServeHTTP(w, r)
+					return
+				}
+				staleEntry = entry
+			}
+			cacheKey = &k
+		}
+
+		var features []string
+		longRunning := isLongRunning(r, subpath)
+		switch {
+		case strings.HasPrefix(tunnelTarget, tunnel.TargetServicePrefix):
+			name := strings.TrimPrefix(tunnelTarget, tunnel.TargetServicePrefix)
+			if findService(cluster, name) == nil {
+				policy.WriteStatusError(w, apierrors.NewNotFound(schema.GroupResource{Resource: "services"}, name))
+				return
+			}
+			features = append(features, tunnel.FeatureServiceProxy)
+			longRunning = httpstream.IsUpgradeRequest(r)
+		case strings.HasPrefix(tunnelTarget, tunnel.TargetEndpointPrefix):
+			name := strings.TrimPrefix(tunnelTarget, tunnel.TargetEndpointPrefix)
+			if findEndpoint(cluster, name) == nil {
+				policy.WriteStatusError(w, apierrors.NewNotFound(schema.GroupResource{Resource: "endpoints"}, name))
+				return
+			}
+			if !strings.EqualFold(r.Header.Get("Upgrade"), tunnel.TCPUpgradeProtocol) {
+				policy.WriteStatusError(w, apierrors.NewBadRequest(fmt.Sprintf("upgrade to %s is required", tunnel.TCPUpgradeProtocol)))
+				return
+			}
+			features = append(features, tunnel.FeatureTCPForward)
+			longRunning = true
+		}
+
+		if limiter != nil {
+			release, err := limiter.Acquire(cluster, longRunning)
+			if err != nil {
+				policy.WriteStatusError(w, err)
+				return
+			}
+			defer release()
+		}
+
 		target, err := url.Parse("http://127.0.0.1")
 		if err != nil {
 			panic(err)
 		}
 
+		// TCP forwarded endpoints carry raw connections, which are not compressed
+		var compression tunnel.Compression
+		if !strings.HasPrefix(tunnelTarget, tunnel.TargetEndpointPrefix) {
+			compression = effectiveCompression(cluster)
+		}
+
+		var sess *yamux.Session
 		rp := httputil.NewSingleHostReverseProxy(target)
 		origDirector := rp.Director
 		rp.Director = func(r *http.Request) {
 			origDirector(r)
 			r.URL.Path = subpath
+			// only the hub may address targets other than the apiserver, or ask for compression
+			r.Header.Del(tunnel.TargetHeader)
+			if tunnelTarget != "" {
+				r.Header.Set(tunnel.TargetHeader, tunnelTarget)
+			}
+			r.Header.Del(tunnel.CompressionHeader)
+			if compression.Algorithm != "" && compression.Algorithm != tunnel.CompressionNone {
+				r.Header.Set(tunnel.CompressionHeader, compression.String())
+			}
+			if staleEntry != nil && staleEntry.etag != "" {
+				r.Header.Del("If-Modified-Since")
+				r.Header.Set("If-None-Match", staleEntry.etag)
+			}
 		}
 		rp.Transport = &http.Transport{
-			Dial: func(network string, addr string) (net.Conn, error) {
-				return sessionManager.DialCluster(key)
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				conn, err := sessionManager.DialCluster(key, features...)
+				if err != nil {
+					return nil, err
+				}
+				if stream, ok := conn.(*yamux.Stream); ok {
+					sess = stream.Session()
+				}
+				return newIdleTimeoutConn(conn, hub.C.StreamIdleTimeout), nil
 			},
+			// the transport is discarded after this request, so do not leave idle streams open on the session
+			DisableKeepAlives: true,
+			// leave content encoding to the member apiserver and the client
+			DisableCompression: true,
+		}
+		watch := tunnelTarget == "" && isWatch(subpath, r.URL.Query())
+		if tunnelTarget != "" || watch {
+			rp.FlushInterval = -1
+		}
+		rp.ModifyResponse = func(res *http.Response) error {
+			// agents mark the responses they compressed for the tunnel; older agents never do
+			if algorithm := res.Header.Get(tunnel.ContentEncodingHeader); algorithm != "" {
+				res.Header.Del(tunnel.ContentEncodingHeader)
+				res.Header.Del("Content-Length")
+				res.ContentLength = -1
+				res.Body = newDecompressBody(res.Body, algorithm, key)
+			}
+			if watch && res.StatusCode == http.StatusOK {
+				res.Body = newWatchBody(res.Body, key, res.Header, sess, hub.C.WatchKeepaliveInterval)
+			}
+			if cacheKey != nil {
+				return cache.update(*cacheKey, staleEntry, clientETag, sess, res)
+			}
+			return nil
 		}
 		if peerManager != nil {
 			rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
@@ -202,7 +511,70 @@ func NewProxyHandler(client clientset.Interface, sessionManager SessionManager,
 	})
 }
 
+func NewKubeconfigSubresource(kubeClient kubernetes.Interface, lister kopilotlisters.ClusterLister) *subresourceserver.Subresource {
+	return &subresourceserver.Subresource{
+		NamespaceScoped:      true,
+		GroupVersionResource: GroupVersionResource,
+		Name:                 "kubeconfig",
+		ConnectMethods:       []string{http.MethodGet},
+		Connect: func(ctx context.Context, key types.NamespacedName) (http.Handler, error) {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cluster, err := lister.Clusters(key.Namespace).Get(key.Name)
+				if err != nil {
+					if apierrors.IsNotFound(err) {
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					http.Error(w, fmt.Sprintf("failed to get cluster: %s", err), http.StatusInternalServerError)
+					return
+				}
+
+				user := userFromRequest(r)
+				clusters := []*kopilotv1alpha1.Cluster{cluster}
+				if all, _ := strconv.ParseBool(r.URL.Query().Get("all")); all {
+					clusterList, err := lister.List(labels.Everything())
+					if err != nil {
+						http.Error(w, fmt.Sprintf("failed to list clusters: %s", err), http.StatusInternalServerError)
+						return
+					}
+
+					var others []*kopilotv1alpha1.Cluster
+					for _, c := range clusterList {
+						if c.Namespace != key.Namespace || c.Name != key.Name {
+							others = append(others, c)
+						}
+					}
+					clusters = append(clusters, user.allowedClusters(r.Context(), kubeClient, others)...)
+				}
+
+				caData, err := ioutil.ReadFile(hub.C.APIServerCAFile)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to load apiserver CA: %s", err), http.StatusInternalServerError)
+					return
+				}
+
+				data, err := clientcmd.Write(*buildKubeconfig(clusters, key, user.Name, caData))
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to encode kubeconfig: %s", err), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/yaml")
+				w.Write(data)
+			}), nil
+		},
+	}
+}
+
 type PeerManager interface {
 	ListPeers(ctx context.Context) ([]string, error)
 	TryNextPeer(w http.ResponseWriter, r *http.Request, e error, key types.NamespacedName, nextPeer func() string)
+	// ListPeerSessions returns the clusters each reachable peer holds sessions
+	// to, along with an error naming the peers which could not be asked.
+	ListPeerSessions(ctx context.Context) ([]PeerSessions, error)
+}
+
+// PeerSessions lists the clusters a peer hub holds sessions to.
+type PeerSessions struct {
+	HubID    string   `json:"hubID"`
+	Clusters []string `json:"clusters"`
 }
@@ -0,0 +1,132 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/hub"
+)
+
+// requestUser is the host cluster user on whose behalf kube-apiserver
+// forwarded a request to the hub.
+type requestUser struct {
+	Name   string
+	Groups []string
+	Extra  map[string]authorizationv1.ExtraValue
+}
+
+func userFromRequest(r *http.Request) requestUser {
+	u := requestUser{
+		Name:   r.Header.Get(hub.C.UserHeader),
+		Groups: r.Header.Values(hub.C.GroupHeader),
+		Extra:  map[string]authorizationv1.ExtraValue{},
+	}
+	prefix := http.CanonicalHeaderKey(hub.C.ExtraHeaderPrefix)
+	for k, v := range r.Header {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		extraKey := strings.ToLower(strings.TrimPrefix(k, prefix))
+		if unescaped, err := url.PathUnescape(extraKey); err == nil {
+			extraKey = unescaped
+		}
+		u.Extra[extraKey] = v
+	}
+	return u
+}
+
+// can reports whether the user is allowed to perform verb on the given
+// subresource of a cluster.
+func (u requestUser) can(ctx context.Context, kubeClient kubernetes.Interface, verb string, subresource string, namespace string, name string) (bool, error) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   u.Name,
+			Groups: u.Groups,
+			Extra:  u.Extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Group:       GroupVersionResource.Group,
+				Version:     GroupVersionResource.Version,
+				Resource:    GroupVersionResource.Resource,
+				Subresource: subresource,
+				Name:        name,
+			},
+		},
+	}
+	result, err := kubeClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return result.Status.Allowed, nil
+}
+
+// maxConcurrentReviews bounds the access reviews sent at the same time for
+// one request.
+const maxConcurrentReviews = 10
+
+// allowedClusters returns those of clusters the user is allowed to proxy to.
+// A single review of all clusters is tried first, and the clusters are then
+// reviewed one by one. Clusters whose review fails are left out.
+func (u requestUser) allowedClusters(ctx context.Context, kubeClient kubernetes.Interface, clusters []*kopilotv1alpha1.Cluster) []*kopilotv1alpha1.Cluster {
+	if len(clusters) == 0 {
+		return nil
+	}
+	if allowed, err := u.can(ctx, kubeClient, "get", "proxy", "", ""); err != nil {
+		log.Printf("failed to review access of %q to all clusters: %s", u.Name, err)
+	} else if allowed {
+		return clusters
+	}
+
+	allowed := make([]bool, len(clusters))
+	reviews := make(chan struct{}, maxConcurrentReviews)
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		wg.Add(1)
+		reviews <- struct{}{}
+		go func(i int, cluster *kopilotv1alpha1.Cluster) {
+			defer wg.Done()
+			defer func() { <-reviews }()
+			ok, err := u.can(ctx, kubeClient, "get", "proxy", cluster.Namespace, cluster.Name)
+			if err != nil {
+				log.Printf("failed to review access of %q to cluster %q: %s", u.Name, cluster.Namespace+"/"+cluster.Name, err)
+				return
+			}
+			allowed[i] = ok
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	var result []*kopilotv1alpha1.Cluster
+	for i, cluster := range clusters {
+		if allowed[i] {
+			result = append(result, cluster)
+		}
+	}
+	return result
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// isWatch reports whether a member cluster request path and query describe a
+// watch, either via the watch parameter or the deprecated /watch/ path prefix.
+func isWatch(path string, query url.Values) bool {
+	if watch, err := strconv.ParseBool(query.Get("watch")); err == nil && watch {
+		return true
+	}
+
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(segs) >= 3 && segs[0] == "api":
+		return segs[2] == "watch"
+	case len(segs) >= 4 && segs[0] == "apis":
+		return segs[3] == "watch"
+	}
+	return false
+}
+
+// watchBody wraps the response body of a watch carried by a session. Events
+// are passed on whole, so that when reading from the tunnel fails, the
+// partial event is dropped and the watch ends with an ERROR event carrying a
+// Status, as the apiserver would end it. Clients then resume from their last
+// resource version instead of seeing an aborted response. Watches in a format
+// whose events cannot be told apart end without the ERROR event. While the
+// watch is idle, the session is pinged periodically, and a session that fails
+// to answer is closed, so that the watch ends instead of hanging.
+type watchBody struct {
+	io.ReadCloser
+	key     types.NamespacedName
+	framer  watchFramer
+	pending []byte
+	out     []byte
+	ended   bool
+
+	// lastRead is the time of the last read from the tunnel in Unix nanoseconds
+	lastRead  int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// watchFramer finds the ends of the events of a watch.
+type watchFramer interface {
+	// scan returns the end of the last event completed in data, which follows
+	// the data scanned before, or -1 if none is.
+	scan(data []byte) int
+	// errorEvent returns an ERROR event carrying status.
+	errorEvent(status *metav1.Status) ([]byte, error)
+}
+
+func newWatchBody(body io.ReadCloser, key types.NamespacedName, header http.Header, sess *yamux.Session, keepaliveInterval time.Duration) io.ReadCloser {
+	b := &watchBody{
+		ReadCloser: body,
+		key:        key,
+		lastRead:   time.Now().UnixNano(),
+		done:       make(chan struct{}),
+	}
+	if sess != nil && keepaliveInterval > 0 {
+		go b.keepalive(sess, keepaliveInterval)
+	}
+	if header.Get("Content-Encoding") == "" {
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		switch mediaType {
+		case runtime.ContentTypeJSON:
+			b.framer = &jsonWatchFramer{}
+		case runtime.ContentTypeProtobuf:
+			b.framer = &protobufWatchFramer{}
+		}
+	}
+	return b
+}
+
+func (b *watchBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.ended {
+			return 0, io.EOF
+		}
+		if b.framer == nil {
+			n, err := b.ReadCloser.Read(p)
+			atomic.StoreInt64(&b.lastRead, time.Now().UnixNano())
+			if err != nil && err != io.EOF {
+				log.Printf("watch on cluster %q interrupted: %s", b.key, err)
+				return n, io.EOF
+			}
+			return n, err
+		}
+		b.fill(len(p))
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+// fill reads from the tunnel and moves the events it completes to out.
+func (b *watchBody) fill(size int) {
+	chunk := make([]byte, size)
+	n, err := b.ReadCloser.Read(chunk)
+	atomic.StoreInt64(&b.lastRead, time.Now().UnixNano())
+	chunk = chunk[:n]
+	if end := b.framer.scan(chunk); end >= 0 {
+		complete := len(b.pending) + end
+		b.pending = append(b.pending, chunk...)
+		b.out = append(b.out, b.pending[:complete]...)
+		b.pending = append([]byte(nil), b.pending[complete:]...)
+	} else {
+		b.pending = append(b.pending, chunk...)
+	}
+
+	switch {
+	case err == io.EOF:
+		b.out = append(b.out, b.pending...)
+		b.ended = true
+	case err != nil:
+		log.Printf("watch on cluster %q interrupted: %s", b.key, err)
+		status := apierrors.NewServiceUnavailable(fmt.Sprintf("watch on cluster %q interrupted: %s", b.key, err)).Status()
+		status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+		event, err := b.framer.errorEvent(&status)
+		if err != nil {
+			log.Printf("failed to encode watch error event: %s", err)
+		}
+		b.out = append(b.out, event...)
+		b.ended = true
+	}
+}
+
+func (b *watchBody) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	return b.ReadCloser.Close()
+}
+
+// keepalive pings sess whenever nothing was read from the watch for
+// interval, and closes sess if it fails to answer.
+func (b *watchBody) keepalive(sess *yamux.Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-sess.CloseChan():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&b.lastRead))) < interval {
+				continue
+			}
+			if _, err := sess.Ping(); err != nil {
+				log.Printf("closing session of cluster %q carrying an idle watch: %s", b.key, err)
+				sess.Close()
+				return
+			}
+		}
+	}
+}
+
+// jsonWatchFramer tells apart the JSON objects of a watch, which may be
+// indented if the client asked for pretty output.
+type jsonWatchFramer struct {
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func (f *jsonWatchFramer) scan(data []byte) int {
+	end := -1
+	for i, c := range data {
+		switch {
+		case f.inString:
+			switch {
+			case f.escaped:
+				f.escaped = false
+			case c == '\\':
+				f.escaped = true
+			case c == '"':
+				f.inString = false
+			}
+		case c == '"':
+			f.inString = true
+		case c == '{' || c == '[':
+			f.depth++
+		case c == '}' || c == ']':
+			f.depth--
+			if f.depth == 0 {
+				end = i + 1
+			}
+		case c == '\n' && f.depth == 0 && end == i:
+			// keep the newline following an event with it
+			end = i + 1
+		}
+	}
+	return end
+}
+
+func (f *jsonWatchFramer) errorEvent(status *metav1.Status) ([]byte, error) {
+	object, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&metav1.WatchEvent{
+		Type:   string(watch.Error),
+		Object: runtime.RawExtension{Raw: object},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// protobufWatchFramer tells apart the frames of a protobuf watch, each
+// prefixed by its length in 4 bytes.
+type protobufWatchFramer struct {
+	header    []byte
+	remaining int
+}
+
+func (f *protobufWatchFramer) scan(data []byte) int {
+	end := -1
+	for i := 0; i < len(data); {
+		if f.remaining == 0 {
+			f.header = append(f.header, data[i])
+			i++
+			if len(f.header) == 4 {
+				f.remaining = int(binary.BigEndian.Uint32(f.header))
+				f.header = f.header[:0]
+				if f.remaining == 0 {
+					end = i
+				}
+			}
+			continue
+		}
+		n := len(data) - i
+		if n > f.remaining {
+			n = f.remaining
+		}
+		f.remaining -= n
+		i += n
+		if f.remaining == 0 {
+			end = i
+		}
+	}
+	return end
+}
+
+func (f *protobufWatchFramer) errorEvent(status *metav1.Status) ([]byte, error) {
+	var object bytes.Buffer
+	// only decoding needs a scheme
+	if err := protobuf.NewSerializer(nil, nil).Encode(status, &object); err != nil {
+		return nil, err
+	}
+	event, err := (&metav1.WatchEvent{
+		Type:   string(watch.Error),
+		Object: runtime.RawExtension{Raw: object.Bytes()},
+	}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 4, 4+len(event))
+	binary.BigEndian.PutUint32(data, uint32(len(event)))
+	return append(data, event...), nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// chunkedBody returns its chunks one per read, then err.
+type chunkedBody struct {
+	chunks [][]byte
+	err    error
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if len(b.chunks) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.chunks[0])
+	if n < len(b.chunks[0]) {
+		b.chunks[0] = b.chunks[0][n:]
+	} else {
+		b.chunks = b.chunks[1:]
+	}
+	return n, nil
+}
+
+func (b *chunkedBody) Close() error {
+	return nil
+}
+
+func protobufFrame(payload string) string {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	return string(header) + payload
+}
+
+func TestWatchBody(t *testing.T) {
+	interrupted := errors.New("session shutdown")
+	added := `{"type":"ADDED","object":{"kind":"Pod","metadata":{"name":"a"}}}` + "\n"
+	modified := `{"type":"MODIFIED","object":{"kind":"Pod","metadata":{"name":"a","annotations":{"x":"}\"{"}}}}` + "\n"
+	pretty := "{\n  \"type\": \"DELETED\",\n  \"object\": {\n    \"kind\": \"Pod\"\n  }\n}\n"
+	first := protobufFrame("first event")
+	second := protobufFrame("second event")
+
+	tests := []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		chunks          []string
+		err             error
+		want            string
+		wantErrorEvent  bool
+	}{
+		{
+			name:        "json events",
+			contentType: "application/json",
+			chunks:      []string{added + modified},
+			err:         io.EOF,
+			want:        added + modified,
+		},
+		{
+			name:        "json event split across reads",
+			contentType: "application/json",
+			chunks:      []string{added[:10], added[10:40], added[40:] + modified[:5], modified[5:]},
+			err:         io.EOF,
+			want:        added + modified,
+		},
+		{
+			name:        "pretty json events",
+			contentType: "application/json;stream=watch",
+			chunks:      []string{pretty[:20], pretty[20:] + added},
+			err:         io.EOF,
+			want:        pretty + added,
+		},
+		{
+			name:           "json interrupted mid-event",
+			contentType:    "application/json",
+			chunks:         []string{added + modified[:30]},
+			err:            interrupted,
+			want:           added,
+			wantErrorEvent: true,
+		},
+		{
+			name:           "json interrupted between events",
+			contentType:    "application/json",
+			chunks:         []string{added, modified},
+			err:            interrupted,
+			want:           added + modified,
+			wantErrorEvent: true,
+		},
+		{
+			name:           "json interrupted within a string",
+			contentType:    "application/json",
+			chunks:         []string{added, modified[:len(modified)-12]},
+			err:            interrupted,
+			want:           added,
+			wantErrorEvent: true,
+		},
+		{
+			name:        "protobuf frames split across reads",
+			contentType: "application/vnd.kubernetes.protobuf;stream=watch",
+			chunks:      []string{first[:2], first[2:7], first[7:] + second[:3], second[3:]},
+			err:         io.EOF,
+			want:        first + second,
+		},
+		{
+			name:           "protobuf interrupted mid-frame",
+			contentType:    "application/vnd.kubernetes.protobuf",
+			chunks:         []string{first + second[:6]},
+			err:            interrupted,
+			want:           first,
+			wantErrorEvent: true,
+		},
+		{
+			name:           "protobuf interrupted within the length",
+			contentType:    "application/vnd.kubernetes.protobuf",
+			chunks:         []string{first + second[:2]},
+			err:            interrupted,
+			want:           first,
+			wantErrorEvent: true,
+		},
+		{
+			name:        "unknown format passed through",
+			contentType: "application/yaml",
+			chunks:      []string{"type: ADDED\n", "obj"},
+			err:         interrupted,
+			want:        "type: ADDED\nobj",
+		},
+		{
+			name:            "encoded events passed through",
+			contentType:     "application/json",
+			contentEncoding: "gzip",
+			chunks:          []string{added[:10]},
+			err:             interrupted,
+			want:            added[:10],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &chunkedBody{err: tt.err}
+			for _, c := range tt.chunks {
+				source.chunks = append(source.chunks, []byte(c))
+			}
+			header := http.Header{}
+			header.Set("Content-Type", tt.contentType)
+			if tt.contentEncoding != "" {
+				header.Set("Content-Encoding", tt.contentEncoding)
+			}
+			body := newWatchBody(source, types.NamespacedName{Namespace: "default", Name: "sample"}, header, nil, 0)
+			defer body.Close()
+
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading watch: %s", err)
+			}
+			if !bytes.HasPrefix(data, []byte(tt.want)) {
+				t.Fatalf("got %q, want it to start with %q", data, tt.want)
+			}
+			rest := data[len(tt.want):]
+			if !tt.wantErrorEvent {
+				if len(rest) > 0 {
+					t.Fatalf("got %q after the events, want nothing", rest)
+				}
+				return
+			}
+
+			status := decodeErrorEvent(t, tt.contentType, rest)
+			if status.Code != http.StatusServiceUnavailable || status.Reason != metav1.StatusReasonServiceUnavailable {
+				t.Errorf("got status %d %s, want %d %s", status.Code, status.Reason, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable)
+			}
+		})
+	}
+}
+
+func TestWatchBodyKeepalive(t *testing.T) {
+	tests := []struct {
+		name       string
+		answering  bool
+		wantClosed bool
+	}{
+		{
+			name:      "answered pings keep the session",
+			answering: true,
+		},
+		{
+			name:       "unanswered pings close the session",
+			wantClosed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hubConn, agentConn := net.Pipe()
+			defer agentConn.Close()
+			config := yamux.DefaultConfig()
+			config.EnableKeepAlive = false
+			config.ConnectionWriteTimeout = 50 * time.Millisecond
+			config.LogOutput = ioutil.Discard
+			sess, err := yamux.Server(hubConn, config)
+			if err != nil {
+				t.Fatalf("creating session: %s", err)
+			}
+			defer sess.Close()
+			if tt.answering {
+				agentSess, err := yamux.Client(agentConn, config)
+				if err != nil {
+					t.Fatalf("creating agent session: %s", err)
+				}
+				defer agentSess.Close()
+			}
+
+			body := newWatchBody(&chunkedBody{}, types.NamespacedName{Namespace: "default", Name: "sample"}, http.Header{}, sess, 10*time.Millisecond)
+			defer body.Close()
+
+			select {
+			case <-sess.CloseChan():
+				if !tt.wantClosed {
+					t.Fatal("session closed, want it kept")
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.wantClosed {
+					t.Fatal("session kept, want it closed")
+				}
+			}
+		})
+	}
+}
+
+// decodeErrorEvent decodes data as a single ERROR event carrying a Status.
+func decodeErrorEvent(t *testing.T, contentType string, data []byte) *metav1.Status {
+	var event metav1.WatchEvent
+	status := &metav1.Status{}
+	if contentType == "application/json" {
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			t.Fatalf("got ERROR event %q, want it to end with a newline", data)
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatalf("decoding ERROR event: %s", err)
+		}
+		if err := json.Unmarshal(event.Object.Raw, status); err != nil {
+			t.Fatalf("decoding status: %s", err)
+		}
+	} else {
+		if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 {
+			t.Fatalf("got ERROR frame %q, want it to be prefixed with its length", data)
+		}
+		if err := event.Unmarshal(data[4:]); err != nil {
+			t.Fatalf("decoding ERROR event: %s", err)
+		}
+		scheme := runtime.NewScheme()
+		metav1.AddToGroupVersion(scheme, schema.GroupVersion{Version: "v1"})
+		obj, _, err := protobuf.NewSerializer(scheme, scheme).Decode(event.Object.Raw, nil, status)
+		if err != nil {
+			t.Fatalf("decoding status: %s", err)
+		}
+		status = obj.(*metav1.Status)
+	}
+	if event.Type != "ERROR" {
+		t.Errorf("got event type %q, want ERROR", event.Type)
+	}
+	return status
+}
@@ -17,7 +17,15 @@ limitations under the License.
 package hub
 
 import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/namsral/flag"
+
+	"github.com/smartxworks/kopilot/pkg/tunnel"
 )
 
 type Config struct {
@@ -25,25 +33,150 @@ type Config struct {
 	PublicAddr       string
 	PeerBindAddr     string
 	PeerCertDir      string
+	PublicBindAddr   string
+	PublicCertDir    string
+	PublicCAFile     string
+	APIServerAddr    string
 	ServiceNamespace string
 	ServiceName      string
 	IP               string
+	APIServerCAFile  string
+
+	UserHeader        string
+	GroupHeader       string
+	ExtraHeaderPrefix string
+
+	MinAgentProtocolVersion int
+	AllowRawWebSocket       bool
+	AgentSyncInterval       time.Duration
+
+	Session tunnel.SessionConfig
+
+	StreamIdleTimeout      time.Duration
+	WatchKeepaliveInterval time.Duration
+
+	ClusterQPS                    int
+	ClusterBurst                  int
+	ClusterMaxInflight            int
+	ClusterMaxInflightLongRunning int
+
+	Compression      string
+	CompressionLevel int
+
+	MetricsBindAddr string
+
+	DiscoveryCacheTTL time.Duration
+
+	FanoutWorkers int
+
+	ClusterProbeInterval time.Duration
+	ClusterProbeWorkers  int
+	InventoryLabels      bool
 }
 
 var C = Config{
 	PublicAddr:       "kubernetes.default",
 	PeerBindAddr:     ":6443",
 	PeerCertDir:      "/tmp/k8s-subresource-server/cert",
+	PublicCertDir:    "/tmp/k8s-public-server/cert",
 	ServiceNamespace: "kopilot-system",
 	ServiceName:      "kopilot-hub",
+	APIServerCAFile:  "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+
+	UserHeader:        "X-Remote-User",
+	GroupHeader:       "X-Remote-Group",
+	ExtraHeaderPrefix: "X-Remote-Extra-",
+
+	AllowRawWebSocket: true,
+	AgentSyncInterval: time.Minute,
+
+	Session: tunnel.DefaultSessionConfig(),
+
+	StreamIdleTimeout:      4 * time.Hour,
+	WatchKeepaliveInterval: 15 * time.Second,
+
+	ClusterMaxInflight: 400,
+
+	Compression: "None",
+
+	DiscoveryCacheTTL: 10 * time.Minute,
+
+	FanoutWorkers: 20,
+
+	ClusterProbeInterval: time.Minute,
+	ClusterProbeWorkers:  10,
 }
 
 func InitFlags(flag *flag.FlagSet) {
 	flag.StringVar(&C.AgentImage, "agent-image", C.AgentImage, "")
-	flag.StringVar(&C.PublicAddr, "public-addr", C.PublicAddr, "public address of server")
+	flag.StringVar(&C.PublicAddr, "public-addr", C.PublicAddr, "public address agents connect to: host of kube-apiserver, or URL of the public listener such as https://kopilot.example.com/hub")
 	flag.StringVar(&C.PeerBindAddr, "peer-bind", C.PeerBindAddr, "peer server bind address")
 	flag.StringVar(&C.PeerCertDir, "peer-cert-dir", C.PeerCertDir, "certificate directory of peer server")
+	flag.StringVar(&C.PublicBindAddr, "public-bind", C.PublicBindAddr, "bind address of the public listener serving agents without kube-apiserver, such as :7443, empty to disable")
+	flag.StringVar(&C.PublicCertDir, "public-cert-dir", C.PublicCertDir, "certificate directory of public listener, holding tls.crt and tls.key issued for the host of public-addr")
+	flag.StringVar(&C.PublicCAFile, "public-ca-file", C.PublicCAFile, "CA certificate of the public listener embedded into agent manifests, empty if agents verify it with their system roots")
+	flag.StringVar(&C.APIServerAddr, "apiserver-addr", C.APIServerAddr, "address of kube-apiserver embedded into generated kubeconfigs, defaults to public-addr if it is a host")
 	flag.StringVar(&C.ServiceNamespace, "service-namespace", C.ServiceNamespace, "namespace of kopilot-hub service")
 	flag.StringVar(&C.ServiceName, "service-name", C.ServiceName, "name of kopilot-hub service")
 	flag.StringVar(&C.IP, "ip", C.IP, "IP")
+	flag.StringVar(&C.APIServerCAFile, "apiserver-ca-file", C.APIServerCAFile, "CA certificate of kube-apiserver embedded into generated kubeconfigs, and into agent manifests if agents connect through kube-apiserver")
+	flag.StringVar(&C.UserHeader, "user-header", C.UserHeader, "request header carrying the user name set by kube-apiserver")
+	flag.StringVar(&C.GroupHeader, "group-header", C.GroupHeader, "request header carrying the user groups set by kube-apiserver")
+	flag.StringVar(&C.ExtraHeaderPrefix, "extra-header-prefix", C.ExtraHeaderPrefix, "request header prefix carrying extra user info set by kube-apiserver")
+	flag.IntVar(&C.MinAgentProtocolVersion, "min-agent-protocol-version", C.MinAgentProtocolVersion, "oldest protocol version of agents allowed to connect, 0 to allow agents predating the handshake")
+	flag.BoolVar(&C.AllowRawWebSocket, "allow-raw-websocket", C.AllowRawWebSocket, "accept agents which carry the session on the underlying connection of the WebSocket instead of in WebSocket messages, as agents before framing do")
+	flag.DurationVar(&C.AgentSyncInterval, "agent-sync-interval", C.AgentSyncInterval, "interval at which connected agents are synced with the image, services, endpoints and host services of their cluster and their status is reported, 0 to disable")
+	tunnel.InitSessionFlags(flag, &C.Session)
+	flag.DurationVar(&C.StreamIdleTimeout, "stream-idle-timeout", C.StreamIdleTimeout, "maximum time a proxied connection to a member cluster may stay idle, including exec, attach and port-forward sessions")
+	flag.IntVar(&C.ClusterQPS, "cluster-qps", C.ClusterQPS, "default rate of short-running requests per second to each cluster, 0 for unlimited")
+	flag.IntVar(&C.ClusterBurst, "cluster-burst", C.ClusterBurst, "default burst of short-running requests to each cluster")
+	flag.IntVar(&C.ClusterMaxInflight, "cluster-max-inflight", C.ClusterMaxInflight, "default maximum of concurrent short-running requests to each cluster, 0 for unlimited")
+	flag.IntVar(&C.ClusterMaxInflightLongRunning, "cluster-max-inflight-long-running", C.ClusterMaxInflightLongRunning, "default maximum of concurrent long-running requests to each cluster, 0 for unlimited")
+	flag.StringVar(&C.Compression, "compression", C.Compression, "default compression of responses tunnelled from member clusters: None, Gzip or Deflate")
+	flag.IntVar(&C.CompressionLevel, "compression-level", C.CompressionLevel, "default compression level from 1 (fastest) to 9 (smallest), 0 for the default of the algorithm")
+	flag.StringVar(&C.MetricsBindAddr, "metrics-bind", C.MetricsBindAddr, "metrics server bind address, empty to disable")
+	flag.IntVar(&C.FanoutWorkers, "fanout-workers", C.FanoutWorkers, "number of clusters a fan-out request is sent to at the same time; watches hold a worker until they are established")
+	flag.DurationVar(&C.DiscoveryCacheTTL, "discovery-cache-ttl", C.DiscoveryCacheTTL, "time discovery and OpenAPI documents of member clusters are served from the cache of hub before they are revalidated, 0 to disable the cache")
+	flag.DurationVar(&C.ClusterProbeInterval, "cluster-probe-interval", C.ClusterProbeInterval, "interval at which connected member clusters are probed for their health and inventory, reported in the status of their Cluster, 0 to disable")
+	flag.IntVar(&C.ClusterProbeWorkers, "cluster-probe-workers", C.ClusterProbeWorkers, "number of member clusters probed at the same time")
+	flag.BoolVar(&C.InventoryLabels, "inventory-labels", C.InventoryLabels, "label Clusters with the Kubernetes version, provider and region found by probes")
+	flag.DurationVar(&C.WatchKeepaliveInterval, "watch-keepalive-interval", C.WatchKeepaliveInterval, "interval of inactivity after which sessions carrying watches are pinged, 0 to disable")
+}
+
+// PublicURL returns the URL of the public listener if PublicAddr is one,
+// or nil if agents connect through kube-apiserver at PublicAddr.
+func PublicURL() (*url.URL, error) {
+	if !strings.Contains(C.PublicAddr, "://") {
+		return nil, nil
+	}
+	u, err := url.Parse(C.PublicAddr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q of public URL", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// KubeAPIServerAddr returns the address of kube-apiserver users reach
+// clusters through.
+func KubeAPIServerAddr() string {
+	if C.APIServerAddr != "" {
+		return C.APIServerAddr
+	}
+	if !strings.Contains(C.PublicAddr, "://") {
+		return C.PublicAddr
+	}
+	return "kubernetes.default"
+}
+
+// ID identifies this hub replica to agents and peers.
+func ID() string {
+	if C.IP != "" {
+		return C.IP
+	}
+	hostname, _ := os.Hostname()
+	return hostname
 }
@@ -20,27 +20,34 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 
-	clientset "github.com/smartxworks/kopilot/pkg/client/clientset/versioned"
+	kopilotlisters "github.com/smartxworks/kopilot/pkg/client/listers/kopilot/v1alpha1"
 	"github.com/smartxworks/kopilot/pkg/hub"
 	"github.com/smartxworks/kopilot/pkg/hub/cluster"
+	"github.com/smartxworks/kopilot/pkg/policy"
+	"github.com/smartxworks/kopilot/pkg/tunnel"
 )
 
-func StartServer(ctx context.Context, client clientset.Interface, sessionManager cluster.SessionManager) error {
+func StartServer(ctx context.Context, lister kopilotlisters.ClusterLister, sessionManager cluster.SessionManager) error {
 	r := mux.NewRouter()
 	r.PathPrefix("/proxy/{namespace}/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -49,7 +56,17 @@ func StartServer(ctx context.Context, client clientset.Interface, sessionManager
 			Name:      vars["name"],
 		}
 		subpath := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/proxy/%s/%s", vars["namespace"], vars["name"]))
-		cluster.NewProxyHandler(client, sessionManager, nil, key, subpath).ServeHTTP(w, r)
+		// request limits have been enforced by the hub the request first arrived at,
+		// which also set the target in the member cluster
+		cluster.NewProxyHandler(lister, sessionManager, nil, nil, nil, key, r.Header.Get(tunnel.TargetHeader), subpath).ServeHTTP(w, r)
+	})
+
+	r.Path("/sessions").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster.PeerSessions{
+			HubID:    hub.ID(),
+			Clusters: sessionManager.ListClusters(),
+		})
 	})
 
 	cert, err := tls.LoadX509KeyPair(filepath.Join(hub.C.PeerCertDir, "tls.crt"), filepath.Join(hub.C.PeerCertDir, "tls.key"))
@@ -71,9 +88,10 @@ func StartServer(ctx context.Context, client clientset.Interface, sessionManager
 	}
 
 	server := &http.Server{
-		Addr:      hub.C.PeerBindAddr,
-		Handler:   r,
-		TLSConfig: tlsConfig,
+		Addr:              hub.C.PeerBindAddr,
+		Handler:           r,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 30 * time.Second,
 	}
 
 	idleConnsClosed := make(chan struct{})
@@ -138,10 +156,65 @@ func (m *Manager) ListPeers(ctx context.Context) ([]string, error) {
 	return peers, nil
 }
 
+func (m *Manager) ListPeerSessions(ctx context.Context) ([]cluster.PeerSessions, error) {
+	peers, err := m.ListPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(hub.C.PeerCertDir, "tls.crt"), filepath.Join(hub.C.PeerCertDir, "tls.key"))
+	if err != nil {
+		return nil, fmt.Errorf("load cert: %s", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       []tls.Certificate{cert},
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	var sessions []cluster.PeerSessions
+	var errs []error
+	for _, peer := range peers {
+		s, err := getPeerSessions(ctx, client, peer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("list sessions of peer %s: %s", peer, err))
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	return sessions, utilerrors.NewAggregate(errs)
+}
+
+func getPeerSessions(ctx context.Context, client *http.Client, peer string) (*cluster.PeerSessions, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/sessions", peer), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var s cluster.PeerSessions
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("decode response: %s", err)
+	}
+	return &s, nil
+}
+
 func (m *Manager) TryNextPeer(w http.ResponseWriter, r *http.Request, e error, key types.NamespacedName, nextPeer func() string) {
 	peer := nextPeer()
 	if peer == "" {
-		w.WriteHeader(http.StatusBadGateway)
+		policy.WriteStatusError(w, apierrors.NewServiceUnavailable(fmt.Sprintf("no session found for cluster %q", key)))
 		return
 	}
 
@@ -158,11 +231,20 @@ func (m *Manager) TryNextPeer(w http.ResponseWriter, r *http.Request, e error, k
 	}
 
 	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.FlushInterval = -1
 	rp.Transport = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 			Certificates:       []tls.Certificate{cert},
+			// upgraded connections (exec, attach, port-forward) require HTTP/1.1
+			NextProtos: []string{"http/1.1"},
 		},
+		DisableKeepAlives:  true,
+		DisableCompression: true,
 	}
 	rp.ModifyResponse = func(r *http.Response) error {
 		if r.StatusCode == http.StatusBadGateway {
@@ -0,0 +1,162 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// Attributes describe a request to an apiserver the way RBAC sees it.
+type Attributes struct {
+	// IsResourceRequest is false for requests to non-resource paths, such as
+	// discovery, /version or /healthz, which only have Verb and Path.
+	IsResourceRequest bool
+	// Verb is the lowercased HTTP method for non-resource requests, and the
+	// Kubernetes verb, such as list or watch, for resource requests.
+	Verb        string
+	Path        string
+	APIGroup    string
+	APIVersion  string
+	Namespace   string
+	Resource    string
+	Subresource string
+	Name        string
+}
+
+// ValidatePath returns an error if path has empty, "." or ".." segments,
+// which may be read differently by the apiserver than by NewAttributes, such
+// as ".../namespaces/default//secrets" which could slip past a rule on secrets.
+func ValidatePath(path string) error {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return nil
+	}
+	for _, seg := range strings.Split(trimmed, "/") {
+		switch seg {
+		case "", ".", "..":
+			return fmt.Errorf("invalid path %q: empty, %q or %q segment", path, ".", "..")
+		}
+	}
+	return nil
+}
+
+// NewAttributes parses a request to an apiserver with method, path and query,
+// following the RequestInfoFactory of k8s.io/apiserver.
+func NewAttributes(method string, path string, query url.Values) *Attributes {
+	a := &Attributes{
+		Verb: strings.ToLower(method),
+		Path: path,
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || (parts[0] != "api" && parts[0] != "apis") {
+		return a
+	}
+	if parts[0] == "apis" {
+		if len(parts) < 4 {
+			return a
+		}
+		a.APIGroup = parts[1]
+		parts = parts[1:]
+	}
+	a.APIVersion = parts[1]
+	parts = parts[2:]
+
+	switch method {
+	case "POST":
+		a.Verb = "create"
+	case "GET", "HEAD":
+		a.Verb = "get"
+	case "PUT":
+		a.Verb = "update"
+	case "PATCH":
+		a.Verb = "patch"
+	case "DELETE":
+		a.Verb = "delete"
+	default:
+		a.Verb = ""
+	}
+
+	if parts[0] == "proxy" || parts[0] == "watch" {
+		if len(parts) < 2 {
+			a.APIGroup, a.APIVersion, a.Verb = "", "", strings.ToLower(method)
+			return a
+		}
+		a.Verb = parts[0]
+		parts = parts[1:]
+	}
+
+	if parts[0] == "namespaces" && len(parts) > 1 {
+		a.Namespace = parts[1]
+		if len(parts) > 2 && parts[2] != "status" && parts[2] != "finalize" {
+			parts = parts[2:]
+		}
+	}
+
+	a.IsResourceRequest = true
+	a.Resource = parts[0]
+	if len(parts) >= 2 {
+		a.Name = parts[1]
+	}
+	if len(parts) >= 3 && a.Verb != "proxy" {
+		a.Subresource = parts[2]
+	}
+
+	if len(parts) < 2 && a.Verb == "get" {
+		a.Verb = "list"
+		if watch, _ := strconv.ParseBool(query.Get("watch")); watch {
+			a.Verb = "watch"
+		}
+		if selector, err := fields.ParseSelector(query.Get("fieldSelector")); err == nil {
+			if name, ok := selector.RequiresExactMatch("metadata.name"); ok {
+				a.Name = name
+			}
+		}
+	}
+	if len(parts) < 2 && a.Verb == "delete" {
+		a.Verb = "deletecollection"
+	}
+	return a
+}
+
+// String describes the request for messages, such as `list pods in namespace "default"`.
+func (a *Attributes) String() string {
+	if !a.IsResourceRequest {
+		return fmt.Sprintf("%s %s", a.Verb, a.Path)
+	}
+
+	resource := a.Resource
+	if a.Subresource != "" {
+		resource += "/" + a.Subresource
+	}
+	if a.APIGroup != "" {
+		resource += "." + a.APIGroup
+	}
+	s := fmt.Sprintf("%s %s", a.Verb, resource)
+	if a.Name != "" {
+		s += fmt.Sprintf(" %q", a.Name)
+	}
+	if a.Namespace != "" {
+		s += fmt.Sprintf(" in namespace %q", a.Namespace)
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNewAttributes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		want   Attributes
+	}{
+		{
+			name:   "core namespaced list",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+			want:   Attributes{IsResourceRequest: true, Verb: "list", Path: "/api/v1/namespaces/default/pods", APIVersion: "v1", Namespace: "default", Resource: "pods"},
+		},
+		{
+			name:   "core namespaced get",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods/foo",
+			want:   Attributes{IsResourceRequest: true, Verb: "get", Path: "/api/v1/namespaces/default/pods/foo", APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "foo"},
+		},
+		{
+			name:   "core cluster-scoped get",
+			method: "GET",
+			path:   "/api/v1/nodes/node-1",
+			want:   Attributes{IsResourceRequest: true, Verb: "get", Path: "/api/v1/nodes/node-1", APIVersion: "v1", Resource: "nodes", Name: "node-1"},
+		},
+		{
+			name:   "namespace itself",
+			method: "GET",
+			path:   "/api/v1/namespaces/default",
+			want:   Attributes{IsResourceRequest: true, Verb: "get", Path: "/api/v1/namespaces/default", APIVersion: "v1", Namespace: "default", Resource: "namespaces", Name: "default"},
+		},
+		{
+			name:   "namespace status",
+			method: "PUT",
+			path:   "/api/v1/namespaces/default/status",
+			want:   Attributes{IsResourceRequest: true, Verb: "update", Path: "/api/v1/namespaces/default/status", APIVersion: "v1", Namespace: "default", Resource: "namespaces", Name: "default", Subresource: "status"},
+		},
+		{
+			name:   "group namespaced create",
+			method: "POST",
+			path:   "/apis/apps/v1/namespaces/default/deployments",
+			want:   Attributes{IsResourceRequest: true, Verb: "create", Path: "/apis/apps/v1/namespaces/default/deployments", APIGroup: "apps", APIVersion: "v1", Namespace: "default", Resource: "deployments"},
+		},
+		{
+			name:   "group cluster-scoped list",
+			method: "GET",
+			path:   "/apis/rbac.authorization.k8s.io/v1/clusterroles",
+			want:   Attributes{IsResourceRequest: true, Verb: "list", Path: "/apis/rbac.authorization.k8s.io/v1/clusterroles", APIGroup: "rbac.authorization.k8s.io", APIVersion: "v1", Resource: "clusterroles"},
+		},
+		{
+			name:   "list across namespaces",
+			method: "GET",
+			path:   "/apis/apps/v1/deployments",
+			want:   Attributes{IsResourceRequest: true, Verb: "list", Path: "/apis/apps/v1/deployments", APIGroup: "apps", APIVersion: "v1", Resource: "deployments"},
+		},
+		{
+			name:   "subresource",
+			method: "PATCH",
+			path:   "/apis/apps/v1/namespaces/default/deployments/foo/scale",
+			want:   Attributes{IsResourceRequest: true, Verb: "patch", Path: "/apis/apps/v1/namespaces/default/deployments/foo/scale", APIGroup: "apps", APIVersion: "v1", Namespace: "default", Resource: "deployments", Name: "foo", Subresource: "scale"},
+		},
+		{
+			name:   "exec",
+			method: "POST",
+			path:   "/api/v1/namespaces/default/pods/foo/exec",
+			want:   Attributes{IsResourceRequest: true, Verb: "create", Path: "/api/v1/namespaces/default/pods/foo/exec", APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "foo", Subresource: "exec"},
+		},
+		{
+			name:   "watch parameter",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+			query:  url.Values{"watch": {"true"}},
+			want:   Attributes{IsResourceRequest: true, Verb: "watch", Path: "/api/v1/namespaces/default/pods", APIVersion: "v1", Namespace: "default", Resource: "pods"},
+		},
+		{
+			name:   "watch prefix",
+			method: "GET",
+			path:   "/api/v1/watch/namespaces/default/pods/foo",
+			want:   Attributes{IsResourceRequest: true, Verb: "watch", Path: "/api/v1/watch/namespaces/default/pods/foo", APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "foo"},
+		},
+		{
+			name:   "proxy prefix",
+			method: "GET",
+			path:   "/api/v1/proxy/namespaces/default/services/foo/bar/baz",
+			want:   Attributes{IsResourceRequest: true, Verb: "proxy", Path: "/api/v1/proxy/namespaces/default/services/foo/bar/baz", APIVersion: "v1", Namespace: "default", Resource: "services", Name: "foo"},
+		},
+		{
+			name:   "proxy subresource",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/services/foo/proxy/bar",
+			want:   Attributes{IsResourceRequest: true, Verb: "get", Path: "/api/v1/namespaces/default/services/foo/proxy/bar", APIVersion: "v1", Namespace: "default", Resource: "services", Name: "foo", Subresource: "proxy"},
+		},
+		{
+			name:   "deletecollection",
+			method: "DELETE",
+			path:   "/api/v1/namespaces/default/pods",
+			want:   Attributes{IsResourceRequest: true, Verb: "deletecollection", Path: "/api/v1/namespaces/default/pods", APIVersion: "v1", Namespace: "default", Resource: "pods"},
+		},
+		{
+			name:   "delete",
+			method: "DELETE",
+			path:   "/api/v1/namespaces/default/pods/foo",
+			want:   Attributes{IsResourceRequest: true, Verb: "delete", Path: "/api/v1/namespaces/default/pods/foo", APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "foo"},
+		},
+		{
+			name:   "name from fieldSelector",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/secrets",
+			query:  url.Values{"fieldSelector": {"metadata.name=foo"}},
+			want:   Attributes{IsResourceRequest: true, Verb: "list", Path: "/api/v1/namespaces/default/secrets", APIVersion: "v1", Namespace: "default", Resource: "secrets", Name: "foo"},
+		},
+		{
+			name:   "fieldSelector without name",
+			method: "GET",
+			path:   "/api/v1/namespaces/default/secrets",
+			query:  url.Values{"fieldSelector": {"type=Opaque"}},
+			want:   Attributes{IsResourceRequest: true, Verb: "list", Path: "/api/v1/namespaces/default/secrets", APIVersion: "v1", Namespace: "default", Resource: "secrets"},
+		},
+		{
+			name:   "core discovery",
+			method: "GET",
+			path:   "/api/v1",
+			want:   Attributes{Verb: "get", Path: "/api/v1"},
+		},
+		{
+			name:   "group discovery",
+			method: "GET",
+			path:   "/apis/apps/v1",
+			want:   Attributes{Verb: "get", Path: "/apis/apps/v1"},
+		},
+		{
+			name:   "non-resource",
+			method: "GET",
+			path:   "/healthz",
+			want:   Attributes{Verb: "get", Path: "/healthz"},
+		},
+		{
+			name:   "bare watch prefix",
+			method: "GET",
+			path:   "/api/v1/watch",
+			want:   Attributes{Verb: "get", Path: "/api/v1/watch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewAttributes(tt.method, tt.path, tt.query)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("NewAttributes(%q, %q, %v) = %+v, want %+v", tt.method, tt.path, tt.query, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "/"},
+		{path: ""},
+		{path: "/api/v1/namespaces/default/secrets"},
+		{path: "/api/v1/namespaces/default/secrets/"},
+		{path: "/api/v1/namespaces/default//secrets", wantErr: true},
+		{path: "/api/v1/namespaces/default/./secrets", wantErr: true},
+		{path: "/api/v1/namespaces/default/pods/../secrets", wantErr: true},
+		{path: "/healthz/..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := ValidatePath(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePath(%q) = %v, want error %t", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+)
+
+// Rule allows requests the way a PolicyRule of RBAC does, optionally limited
+// to Namespaces. "*" matches any verb, API group, resource or non-resource
+// URL, "*/subresource" matches subresource of any resource, and a trailing
+// "*" of a non-resource URL matches any suffix.
+type Rule struct {
+	Verbs         []string `json:"verbs"`
+	APIGroups     []string `json:"apiGroups,omitempty"`
+	Resources     []string `json:"resources,omitempty"`
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	// Namespaces limits the rule to namespaced requests in these namespaces.
+	// An empty list matches cluster-scoped requests as well.
+	Namespaces      []string `json:"namespaces,omitempty"`
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+// FromClusterPolicyRule returns the part of rule which matches requests.
+func FromClusterPolicyRule(rule *kopilotv1alpha1.ClusterPolicyRule) *Rule {
+	return &Rule{
+		Verbs:           rule.Verbs,
+		APIGroups:       rule.APIGroups,
+		Resources:       rule.Resources,
+		ResourceNames:   rule.ResourceNames,
+		Namespaces:      rule.Namespaces,
+		NonResourceURLs: rule.NonResourceURLs,
+	}
+}
+
+// Validate reports whether the rule can match any request.
+func (r *Rule) Validate() error {
+	if len(r.Verbs) == 0 {
+		return errors.New("verbs are required")
+	}
+	if len(r.Resources) == 0 && len(r.NonResourceURLs) == 0 {
+		return errors.New("resources or nonResourceURLs are required")
+	}
+	if len(r.Resources) > 0 && len(r.APIGroups) == 0 {
+		return errors.New("apiGroups are required with resources")
+	}
+	return nil
+}
+
+// Matches reports whether the rule allows the request described by a.
+func (r *Rule) Matches(a *Attributes) bool {
+	if !has(r.Verbs, a.Verb) {
+		return false
+	}
+	if !a.IsResourceRequest {
+		for _, u := range r.NonResourceURLs {
+			if u == "*" || u == a.Path || (strings.HasSuffix(u, "*") && strings.HasPrefix(a.Path, strings.TrimSuffix(u, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !has(r.APIGroups, a.APIGroup) {
+		return false
+	}
+	resource := a.Resource
+	if a.Subresource != "" {
+		resource += "/" + a.Subresource
+	}
+	if !has(r.Resources, resource) && !(a.Subresource != "" && has(r.Resources, "*/"+a.Subresource)) {
+		return false
+	}
+	if len(r.ResourceNames) > 0 && !has(r.ResourceNames, a.Name) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && (a.Namespace == "" || !has(r.Namespaces, a.Namespace)) {
+		return false
+	}
+	return true
+}
+
+// Allows reports whether any of rules allows the request described by a.
+func Allows(rules []Rule, a *Attributes) bool {
+	for i := range rules {
+		if rules[i].Matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forbidden returns the error of apiservers rejecting the request described by
+// a for reason.
+func Forbidden(a *Attributes, reason string) *apierrors.StatusError {
+	return apierrors.NewForbidden(schema.GroupResource{Group: a.APIGroup, Resource: a.Resource}, a.Name, fmt.Errorf("%s: %s", a, reason))
+}
+
+// has reports whether values contain value or "*".
+func has(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   Rule
+		method string
+		path   string
+		query  url.Values
+		want   bool
+	}{
+		{
+			name:   "core resource",
+			rule:   Rule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+			want:   true,
+		},
+		{
+			name:   "other verb",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods",
+		},
+		{
+			name:   "other group",
+			rule:   Rule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"deployments"}},
+			method: "GET",
+			path:   "/apis/apps/v1/namespaces/default/deployments",
+		},
+		{
+			name:   "wildcards",
+			rule:   Rule{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			method: "DELETE",
+			path:   "/apis/apps/v1/namespaces/default/deployments/foo",
+			want:   true,
+		},
+		{
+			name:   "resource does not match its subresource",
+			rule:   Rule{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "POST",
+			path:   "/api/v1/namespaces/default/pods/foo/exec",
+		},
+		{
+			name:   "subresource",
+			rule:   Rule{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods/exec"}},
+			method: "POST",
+			path:   "/api/v1/namespaces/default/pods/foo/exec",
+			want:   true,
+		},
+		{
+			name:   "subresource of any resource",
+			rule:   Rule{Verbs: []string{"update"}, APIGroups: []string{"*"}, Resources: []string{"*/status"}},
+			method: "PUT",
+			path:   "/apis/apps/v1/namespaces/default/deployments/foo/status",
+			want:   true,
+		},
+		{
+			name:   "subresource of any resource does not match the resource",
+			rule:   Rule{Verbs: []string{"update"}, APIGroups: []string{"*"}, Resources: []string{"*/status"}},
+			method: "PUT",
+			path:   "/apis/apps/v1/namespaces/default/deployments/foo",
+		},
+		{
+			name:   "resource name",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"foo"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/configmaps/foo",
+			want:   true,
+		},
+		{
+			name:   "other resource name",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"foo"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/configmaps/bar",
+		},
+		{
+			name:   "resource name from fieldSelector",
+			rule:   Rule{Verbs: []string{"list", "watch"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"foo"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/configmaps",
+			query:  url.Values{"watch": {"1"}, "fieldSelector": {"metadata.name=foo"}},
+			want:   true,
+		},
+		{
+			name:   "resource name without fieldSelector",
+			rule:   Rule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"foo"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/configmaps",
+		},
+		{
+			name:   "watch prefix",
+			rule:   Rule{Verbs: []string{"watch"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "GET",
+			path:   "/api/v1/watch/namespaces/default/pods",
+			want:   true,
+		},
+		{
+			name:   "proxy prefix",
+			rule:   Rule{Verbs: []string{"proxy"}, APIGroups: []string{""}, Resources: []string{"services"}},
+			method: "GET",
+			path:   "/api/v1/proxy/namespaces/default/services/foo/bar",
+			want:   true,
+		},
+		{
+			name:   "deletecollection is not delete",
+			rule:   Rule{Verbs: []string{"delete"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "DELETE",
+			path:   "/api/v1/namespaces/default/pods",
+		},
+		{
+			name:   "deletecollection",
+			rule:   Rule{Verbs: []string{"deletecollection"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			method: "DELETE",
+			path:   "/api/v1/namespaces/default/pods",
+			want:   true,
+		},
+		{
+			name:   "namespace",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, Namespaces: []string{"default"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods/foo",
+			want:   true,
+		},
+		{
+			name:   "other namespace",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, Namespaces: []string{"default"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/kube-system/pods/foo",
+		},
+		{
+			name:   "namespaces do not match requests across namespaces",
+			rule:   Rule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}, Namespaces: []string{"default"}},
+			method: "GET",
+			path:   "/api/v1/pods",
+		},
+		{
+			name:   "namespaces do not match cluster-scoped requests",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"nodes"}, Namespaces: []string{"default"}},
+			method: "GET",
+			path:   "/api/v1/nodes/node-1",
+		},
+		{
+			name:   "cluster-scoped",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"nodes"}},
+			method: "GET",
+			path:   "/api/v1/nodes/node-1",
+			want:   true,
+		},
+		{
+			name:   "non-resource URL",
+			rule:   Rule{Verbs: []string{"get"}, NonResourceURLs: []string{"/version"}},
+			method: "GET",
+			path:   "/version",
+			want:   true,
+		},
+		{
+			name:   "non-resource URL prefix",
+			rule:   Rule{Verbs: []string{"get"}, NonResourceURLs: []string{"/apis/*"}},
+			method: "GET",
+			path:   "/apis/apps/v1",
+			want:   true,
+		},
+		{
+			name:   "non-resource URL prefix does not match the bare path",
+			rule:   Rule{Verbs: []string{"get"}, NonResourceURLs: []string{"/apis/*"}},
+			method: "GET",
+			path:   "/apis",
+		},
+		{
+			name:   "any non-resource URL",
+			rule:   Rule{Verbs: []string{"get"}, NonResourceURLs: []string{"*"}},
+			method: "GET",
+			path:   "/healthz",
+			want:   true,
+		},
+		{
+			name:   "non-resource URLs do not match resources",
+			rule:   Rule{Verbs: []string{"get"}, NonResourceURLs: []string{"*"}},
+			method: "GET",
+			path:   "/api/v1/namespaces/default/pods/foo",
+		},
+		{
+			name:   "resources do not match non-resource URLs",
+			rule:   Rule{Verbs: []string{"get"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			method: "GET",
+			path:   "/healthz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := NewAttributes(tt.method, tt.path, tt.query)
+			if got := tt.rule.Matches(attrs); got != tt.want {
+				t.Errorf("Matches(%s) = %t, want %t", attrs, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+)
+
+const (
+	// CompressionHeader is set by the hub on requests to ask the agent to
+	// compress the response with the given Compression.
+	CompressionHeader = "X-Kopilot-Compression"
+	// ContentEncodingHeader is set by the agent on responses it compressed
+	// for the tunnel. It is removed by the hub, which decompresses the body.
+	ContentEncodingHeader = "X-Kopilot-Content-Encoding"
+)
+
+const (
+	CompressionNone    = "none"
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+// Compression is an algorithm and level responses are compressed with in the tunnel.
+type Compression struct {
+	Algorithm string
+	// Level from 1 to 9, or 0 for the default level of the algorithm.
+	Level int
+}
+
+// Compressor compresses data written to it. Flush writes out everything
+// written so far, so that watch events are not held back.
+type Compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (c Compression) String() string {
+	if c.Level == 0 {
+		return c.Algorithm
+	}
+	return mime.FormatMediaType(c.Algorithm, map[string]string{"level": strconv.Itoa(c.Level)})
+}
+
+// ParseCompression parses the value of CompressionHeader.
+func ParseCompression(value string) (Compression, error) {
+	algorithm, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return Compression{}, err
+	}
+
+	c := Compression{
+		Algorithm: algorithm,
+	}
+	if level, ok := params["level"]; ok {
+		if c.Level, err = strconv.Atoi(level); err != nil {
+			return Compression{}, fmt.Errorf("invalid level %q: %s", level, err)
+		}
+	}
+	if c.Level < 0 || c.Level > 9 {
+		return Compression{}, fmt.Errorf("level %d is not between 1 and 9", c.Level)
+	}
+	return c, nil
+}
+
+// NewWriter returns a Compressor writing to w.
+func (c Compression) NewWriter(w io.Writer) (Compressor, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	switch c.Algorithm {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, level)
+	case CompressionDeflate:
+		return flate.NewWriter(w, level)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c.Algorithm)
+	}
+}
+
+// NewReader returns a reader decompressing r, which was compressed with algorithm.
+func NewReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionDeflate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Compression
+		wantErr bool
+	}{
+		{value: "gzip", want: Compression{Algorithm: CompressionGzip}},
+		{value: "deflate;level=1", want: Compression{Algorithm: CompressionDeflate, Level: 1}},
+		{value: "GZIP; level=9", want: Compression{Algorithm: CompressionGzip, Level: 9}},
+		{value: "none", want: Compression{Algorithm: CompressionNone}},
+		{value: "gzip;level=10", wantErr: true},
+		{value: "gzip;level=-1", wantErr: true},
+		{value: "gzip;level=fast", wantErr: true},
+		{value: ";level=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseCompression(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			// the hub sends what the agent parses
+			if again, err := ParseCompression(got.String()); err != nil || again != got {
+				t.Errorf("got %+v, %v parsing %q, want %+v", again, err, got.String(), got)
+			}
+		})
+	}
+}
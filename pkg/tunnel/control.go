@@ -0,0 +1,116 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+const (
+	// TargetHeader selects where the agent sends a request received on a
+	// stream. Requests without it are sent to the apiserver of the member cluster.
+	TargetHeader = "X-Kopilot-Target"
+	// TargetControl selects the control API served by the agent itself.
+	TargetControl = "control"
+	// TargetServicePrefix followed by the name of a Service selects that
+	// service of the member cluster.
+	TargetServicePrefix = "service/"
+	// TargetEndpointPrefix followed by the name of an Endpoint selects that
+	// endpoint of the member cluster.
+	TargetEndpointPrefix = "endpoint/"
+	// TargetHostServicePrefix followed by the name of a HostService selects
+	// that service of the host cluster, on streams opened by the agent.
+	TargetHostServicePrefix = "hostservice/"
+)
+
+// TCPUpgradeProtocol is the protocol of upgrade requests which turn into
+// raw TCP connections to an endpoint.
+const TCPUpgradeProtocol = "kopilot-tcp"
+
+// ServiceTarget returns the target of the service named name.
+func ServiceTarget(name string) string {
+	return TargetServicePrefix + name
+}
+
+// EndpointTarget returns the target of the endpoint named name.
+func EndpointTarget(name string) string {
+	return TargetEndpointPrefix + name
+}
+
+// HostServiceTarget returns the target of the host service named name.
+func HostServiceTarget(name string) string {
+	return TargetHostServicePrefix + name
+}
+
+const (
+	// FeatureSelfUpgrade means the agent serves AgentStatusPath and AgentImagePath
+	// on its control API and rolls its own Deployment out to the image it is given.
+	FeatureSelfUpgrade = "self-upgrade"
+	// FeatureServiceProxy means the agent proxies requests to the services
+	// it is given in HubHello and on AgentServicesPath of its control API.
+	FeatureServiceProxy = "service-proxy"
+	// FeatureTCPForward means the agent forwards upgrade requests with
+	// TCPUpgradeProtocol to the endpoints it is given in HubHello and on
+	// AgentEndpointsPath of its control API.
+	FeatureTCPForward = "tcp-forward"
+	// FeatureReverseTunnel means the agent listens on the ports of the host
+	// services it is given in HubHello and on AgentHostServicesPath of its
+	// control API, and forwards connections to the hub on streams it opens.
+	FeatureReverseTunnel = "reverse-tunnel"
+	// FeatureCompression means the agent compresses responses as asked by
+	// CompressionHeader and marks them with ContentEncodingHeader.
+	FeatureCompression = "compression"
+)
+
+const (
+	AgentStatusPath       = "/agent/status"
+	AgentImagePath        = "/agent/image"
+	AgentServicesPath     = "/agent/services"
+	AgentEndpointsPath    = "/agent/endpoints"
+	AgentHostServicesPath = "/agent/hostservices"
+)
+
+// AgentStatus reports the rollout of the agent Deployment in the member cluster.
+type AgentStatus struct {
+	Image           string `json:"image"`
+	Replicas        int32  `json:"replicas"`
+	UpdatedReplicas int32  `json:"updatedReplicas"`
+	ReadyReplicas   int32  `json:"readyReplicas"`
+}
+
+// AgentImage is sent by the hub to roll the agent Deployment out to Image.
+type AgentImage struct {
+	Image string `json:"image"`
+}
+
+// Service is a service of the member cluster the agent may proxy requests to.
+type Service struct {
+	Name               string `json:"name"`
+	URL                string `json:"url"`
+	CAData             []byte `json:"caData,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// Endpoint is a TCP endpoint of the member cluster the agent may forward connections to.
+type Endpoint struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// HostService is a service of the host cluster the agent forwards connections
+// on Port to.
+type HostService struct {
+	Name string `json:"name"`
+	Port int32  `json:"port"`
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// ProtocolVersion is the version of the protocol spoken over sessions between
+// hub and agent. It is bumped on changes that cannot be negotiated through
+// features. Agents which predate the handshake speak version 0.
+const ProtocolVersion = 1
+
+const (
+	// ProtocolVersionHeader carries the protocol version of the agent on the connect request.
+	ProtocolVersionHeader = "X-Kopilot-Protocol-Version"
+	// AgentVersionHeader carries the build version of the agent on the connect request.
+	AgentVersionHeader = "X-Kopilot-Agent-Version"
+)
+
+// Features lists the protocol features supported by this build. Features
+// are enabled on a session only if both hub and agent support them.
+var Features = []string{
+	FeatureSelfUpgrade,
+	FeatureServiceProxy,
+	FeatureTCPForward,
+	FeatureReverseTunnel,
+	FeatureCompression,
+}
+
+const handshakeTimeout = 30 * time.Second
+
+// AgentHello is sent by the agent on the first stream of a session.
+type AgentHello struct {
+	Version           string   `json:"version"`
+	ProtocolVersion   int      `json:"protocolVersion"`
+	Features          []string `json:"features,omitempty"`
+	ClusterUID        string   `json:"clusterUID,omitempty"`
+	KubernetesVersion string   `json:"kubernetesVersion,omitempty"`
+}
+
+// HubHello is the reply of the hub to AgentHello.
+type HubHello struct {
+	Version         string        `json:"version"`
+	ProtocolVersion int           `json:"protocolVersion"`
+	HubID           string        `json:"hubID"`
+	Features        []string      `json:"features,omitempty"`
+	Services        []Service     `json:"services,omitempty"`
+	Endpoints       []Endpoint    `json:"endpoints,omitempty"`
+	HostServices    []HostService `json:"hostServices,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// HasFeature reports whether the agent advertised feature.
+func (h *AgentHello) HasFeature(feature string) bool {
+	return hasFeature(h.Features, feature)
+}
+
+// HasFeature reports whether feature is enabled on the session.
+func (h *HubHello) HasFeature(feature string) bool {
+	return hasFeature(h.Features, feature)
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// CommonFeatures returns the features of this build that are also in features.
+func CommonFeatures(features []string) []string {
+	var common []string
+	for _, f := range Features {
+		if hasFeature(features, f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
+
+// ParseProtocolVersion parses the value of ProtocolVersionHeader. Agents that
+// do not send the header speak version 0.
+func ParseProtocolVersion(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// Handshake sends hello on a new stream of sess and waits for the reply of
+// the hub. It is called by the agent right after the session is established.
+func Handshake(sess *yamux.Session, hello *AgentHello) (*HubHello, error) {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %s", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := json.NewEncoder(stream).Encode(hello); err != nil {
+		return nil, fmt.Errorf("send hello: %s", err)
+	}
+
+	var reply HubHello
+	if err := json.NewDecoder(stream).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("receive hello: %s", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("rejected by hub: %s", reply.Error)
+	}
+	return &reply, nil
+}
+
+// AcceptHandshake waits for the hello of the agent on the first stream of
+// sess and answers with the reply built by the hub. If reply returns an
+// error, it is sent to the agent and returned.
+func AcceptHandshake(sess *yamux.Session, reply func(hello *AgentHello) (*HubHello, error)) (*AgentHello, *HubHello, error) {
+	accepted := make(chan *yamux.Stream, 1)
+	go func() {
+		if stream, err := sess.AcceptStream(); err == nil {
+			accepted <- stream
+		}
+		close(accepted)
+	}()
+
+	var stream *yamux.Stream
+	select {
+	case stream = <-accepted:
+		if stream == nil {
+			return nil, nil, fmt.Errorf("accept stream: session closed")
+		}
+	case <-time.After(handshakeTimeout):
+		return nil, nil, fmt.Errorf("accept stream: timed out")
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	var hello AgentHello
+	if err := json.NewDecoder(stream).Decode(&hello); err != nil {
+		return nil, nil, fmt.Errorf("receive hello: %s", err)
+	}
+
+	hubHello, err := reply(&hello)
+	if err != nil {
+		json.NewEncoder(stream).Encode(&HubHello{
+			ProtocolVersion: ProtocolVersion,
+			Error:           err.Error(),
+		})
+		return &hello, nil, err
+	}
+	if err := json.NewEncoder(stream).Encode(hubHello); err != nil {
+		return &hello, nil, fmt.Errorf("send hello: %s", err)
+	}
+	return &hello, hubHello, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/namsral/flag"
+)
+
+// SessionConfigHeader carries the session config overrides of the cluster,
+// encoded as JSON, on the response of the hub to the connect request. Agents
+// apply them on top of their own config before the session is established.
+const SessionConfigHeader = "X-Kopilot-Session-Config"
+
+// SessionConfig tunes the yamux sessions between hub and agent. Zero fields
+// are left unchanged by Merge.
+type SessionConfig struct {
+	// KeepAliveInterval is how often the session is pinged.
+	KeepAliveInterval time.Duration `json:"keepAliveInterval,omitempty"`
+	// ConnectionWriteTimeout is how long a write to the underlying connection
+	// may take before the session is considered broken and closed.
+	ConnectionWriteTimeout time.Duration `json:"connectionWriteTimeout,omitempty"`
+	// MaxStreamWindowSize is the receive window of each stream in bytes.
+	MaxStreamWindowSize int `json:"maxStreamWindowSize,omitempty"`
+	// AcceptBacklog is the number of streams which may wait to be accepted
+	// or acknowledged by the other side.
+	AcceptBacklog int `json:"acceptBacklog,omitempty"`
+	// StreamOpenTimeout is how long opening a stream may wait for the backlog.
+	StreamOpenTimeout time.Duration `json:"streamOpenTimeout,omitempty"`
+}
+
+// DefaultSessionConfig returns the defaults of yamux, with a stream open timeout.
+func DefaultSessionConfig() SessionConfig {
+	c := yamux.DefaultConfig()
+	return SessionConfig{
+		KeepAliveInterval:      c.KeepAliveInterval,
+		ConnectionWriteTimeout: c.ConnectionWriteTimeout,
+		MaxStreamWindowSize:    int(c.MaxStreamWindowSize),
+		AcceptBacklog:          c.AcceptBacklog,
+		StreamOpenTimeout:      75 * time.Second,
+	}
+}
+
+// InitSessionFlags registers the flags of c, which are shared by hub and agent.
+func InitSessionFlags(flag *flag.FlagSet, c *SessionConfig) {
+	flag.DurationVar(&c.KeepAliveInterval, "session-keepalive-interval", c.KeepAliveInterval, "interval at which sessions are pinged")
+	flag.DurationVar(&c.ConnectionWriteTimeout, "session-connection-write-timeout", c.ConnectionWriteTimeout, "maximum time a write to the connection of a session may take before the session is closed")
+	flag.IntVar(&c.MaxStreamWindowSize, "session-max-stream-window-size", c.MaxStreamWindowSize, "receive window of each stream in bytes, at least 262144")
+	flag.IntVar(&c.AcceptBacklog, "session-accept-backlog", c.AcceptBacklog, "number of streams which may wait to be accepted")
+	flag.DurationVar(&c.StreamOpenTimeout, "session-stream-open-timeout", c.StreamOpenTimeout, "maximum time opening a stream may wait for the backlog, 0 to wait indefinitely")
+}
+
+// Merge returns c with the non-zero fields of overrides.
+func (c SessionConfig) Merge(overrides SessionConfig) SessionConfig {
+	if overrides.KeepAliveInterval != 0 {
+		c.KeepAliveInterval = overrides.KeepAliveInterval
+	}
+	if overrides.ConnectionWriteTimeout != 0 {
+		c.ConnectionWriteTimeout = overrides.ConnectionWriteTimeout
+	}
+	if overrides.MaxStreamWindowSize != 0 {
+		c.MaxStreamWindowSize = overrides.MaxStreamWindowSize
+	}
+	if overrides.AcceptBacklog != 0 {
+		c.AcceptBacklog = overrides.AcceptBacklog
+	}
+	if overrides.StreamOpenTimeout != 0 {
+		c.StreamOpenTimeout = overrides.StreamOpenTimeout
+	}
+	return c
+}
+
+// YamuxConfig returns the yamux config of c, which is verified.
+func (c SessionConfig) YamuxConfig() (*yamux.Config, error) {
+	if c.MaxStreamWindowSize < 0 || int64(c.MaxStreamWindowSize) > math.MaxUint32 {
+		return nil, fmt.Errorf("max stream window size %d is out of range", c.MaxStreamWindowSize)
+	}
+	config := yamux.DefaultConfig()
+	config.KeepAliveInterval = c.KeepAliveInterval
+	config.ConnectionWriteTimeout = c.ConnectionWriteTimeout
+	config.MaxStreamWindowSize = uint32(c.MaxStreamWindowSize)
+	config.AcceptBacklog = c.AcceptBacklog
+	if err := yamux.VerifyConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c SessionConfig) String() string {
+	return fmt.Sprintf("keepalive interval %s, connection write timeout %s, max stream window size %d, accept backlog %d, stream open timeout %s",
+		c.KeepAliveInterval, c.ConnectionWriteTimeout, c.MaxStreamWindowSize, c.AcceptBacklog, c.StreamOpenTimeout)
+}
+
+// EncodeSessionConfig encodes c as the value of SessionConfigHeader.
+func EncodeSessionConfig(c SessionConfig) string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// ParseSessionConfig parses the value of SessionConfigHeader. Hubs which do
+// not send the header have no overrides.
+func ParseSessionConfig(value string) (SessionConfig, error) {
+	var c SessionConfig
+	if value == "" {
+		return c, nil
+	}
+	if err := json.Unmarshal([]byte(value), &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// OpenStream opens a stream on sess, waiting at most timeout for the backlog
+// of streams not yet acknowledged by the other side to drain. A timeout of 0
+// waits indefinitely.
+func OpenStream(sess *yamux.Session, timeout time.Duration) (*yamux.Stream, error) {
+	if timeout <= 0 {
+		return sess.OpenStream()
+	}
+
+	type result struct {
+		stream *yamux.Stream
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		stream, err := sess.OpenStream()
+		resultCh <- result{stream, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.stream, r.err
+	case <-timer.C:
+		go func() {
+			// the stream is not wanted any more once it is eventually opened
+			if r := <-resultCh; r.stream != nil {
+				r.stream.Close()
+			}
+		}()
+		return nil, fmt.Errorf("open stream: timed out after %s", timeout)
+	}
+}
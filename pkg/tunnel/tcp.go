@@ -0,0 +1,118 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpgradeToTCP upgrades r to a raw TCP connection to addr, which lasts until
+// either side closes it.
+func UpgradeToTCP(w http.ResponseWriter, r *http.Request, addr string) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), TCPUpgradeProtocol) {
+		http.Error(w, fmt.Sprintf("upgrade to %s is required", TCPUpgradeProtocol), http.StatusUpgradeRequired)
+		return
+	}
+
+	backendConn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to dial %s: %s", addr, err), http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("failed to hijack connection to %s: %s", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", TCPUpgradeProtocol)
+	if err := rw.Flush(); err != nil {
+		log.Printf("failed to upgrade connection to %s: %s", addr, err)
+		return
+	}
+	Pipe(&bufferedConn{Conn: conn, r: rw.Reader}, backendConn)
+}
+
+// DialTCPUpgrade sends an upgrade request for target on conn, which must be
+// served by UpgradeToTCP on the other side, and returns the upgraded connection.
+func DialTCPUpgrade(conn net.Conn, target string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://kopilot/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", TCPUpgradeProtocol)
+	req.Header.Set(TargetHeader, target)
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("send upgrade request: %s", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("receive upgrade response: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// Pipe copies between a and b until either side is done, then closes both.
+func Pipe(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// bufferedConn reads through r, which may hold data buffered from Conn.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// TransportWebSocket upgrades the connect request to WebSocket. It passes
+	// through kube-apiserver and is the default.
+	TransportWebSocket = "websocket"
+	// TransportHTTP2 streams the session in both directions of an HTTP/2
+	// CONNECT request to the tunnel port of the hub.
+	TransportHTTP2 = "http2"
+	// TransportTLS sends the connect request over TLS to the tunnel port of
+	// the hub, and carries the session on the bare TLS connection once the hub
+	// accepts it.
+	TransportTLS = "tls"
+)
+
+// ConnectPathHeader carries the path and query of the connect URL on HTTP/2
+// CONNECT requests, which have no path of their own.
+const ConnectPathHeader = "X-Kopilot-Connect-Path"
+
+// Transport carries the session between agent and hub.
+type Transport interface {
+	// Dial sends the connect request of the agent with header to connectURL,
+	// and returns the connection to the hub and the header of its response
+	// once it is accepted.
+	Dial(ctx context.Context, connectURL string, header http.Header, tlsConfig *tls.Config) (io.ReadWriteCloser, http.Header, error)
+	// Accept completes a connect request on the hub with responseHeader, and
+	// returns the connection to the agent. On error, a response has been
+	// written already.
+	Accept(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (io.ReadWriteCloser, error)
+}
+
+// GetTransport returns the transport named name.
+func GetTransport(name string) (Transport, error) {
+	switch name {
+	case TransportWebSocket:
+		return WebSocketTransport{}, nil
+	case TransportHTTP2:
+		return HTTP2Transport{}, nil
+	case TransportTLS:
+		return TLSTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// WebSocketTransport carries the session in binary messages of the
+// WebSocket if both sides agree on WebSocketSubprotocol, and on the
+// underlying connection of the WebSocket otherwise.
+type WebSocketTransport struct {
+	// Raw makes the agent use the underlying connection without asking the hub.
+	Raw bool
+	// AllowRaw makes the hub accept agents using the underlying connection.
+	AllowRaw bool
+}
+
+func (t WebSocketTransport) Dial(ctx context.Context, connectURL string, header http.Header, tlsConfig *tls.Config) (io.ReadWriteCloser, http.Header, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	if !t.Raw {
+		dialer.Subprotocols = []string{WebSocketSubprotocol}
+	}
+	conn, resp, err := dialer.DialContext(ctx, connectURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, nil, responseError(resp)
+		}
+		return nil, nil, err
+	}
+	// hubs which predate framing do not agree on the subprotocol
+	if conn.Subprotocol() != WebSocketSubprotocol {
+		return conn.UnderlyingConn(), resp.Header, nil
+	}
+	return NewWebSocketConn(conn), resp.Header, nil
+}
+
+func (t WebSocketTransport) Accept(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (io.ReadWriteCloser, error) {
+	framed := false
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		if subprotocol == WebSocketSubprotocol {
+			framed = true
+		}
+	}
+	if !framed && !t.AllowRaw {
+		http.Error(w, fmt.Sprintf("WebSocket subprotocol %s is required", WebSocketSubprotocol), http.StatusBadRequest)
+		return nil, errors.New("agent does not frame the session in WebSocket messages")
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{WebSocketSubprotocol},
+	}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// the upgrader has replied already
+		return nil, fmt.Errorf("upgrade to WebSocket: %s", err)
+	}
+	if !framed {
+		return conn.UnderlyingConn(), nil
+	}
+	return NewWebSocketConn(conn), nil
+}
+
+type HTTP2Transport struct{}
+
+func (HTTP2Transport) Dial(ctx context.Context, connectURL string, header http.Header, tlsConfig *tls.Config) (io.ReadWriteCloser, http.Header, error) {
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse connect URL: %s", err)
+	}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, u.String(), pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = header.Clone()
+	req.Header.Set(ConnectPathHeader, u.RequestURI())
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		return nil, nil, responseError(resp)
+	}
+	return &streamConn{
+		Reader: resp.Body,
+		Writer: pw,
+		closers: []io.Closer{
+			pw,
+			resp.Body,
+		},
+	}, resp.Header, nil
+}
+
+func (HTTP2Transport) Accept(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (io.ReadWriteCloser, error) {
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor != 2 || r.Method != http.MethodConnect || !ok {
+		http.Error(w, "HTTP/2 CONNECT is required", http.StatusBadRequest)
+		return nil, errors.New("not an HTTP/2 CONNECT request")
+	}
+	for k, v := range responseHeader {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &streamConn{
+		Reader: r.Body,
+		Writer: &flushWriter{
+			w:       w,
+			flusher: flusher,
+		},
+		closers: []io.Closer{
+			r.Body,
+		},
+		done: make(chan struct{}),
+	}, nil
+}
+
+type TLSTransport struct{}
+
+func (TLSTransport) Dial(ctx context.Context, connectURL string, header http.Header, tlsConfig *tls.Config) (io.ReadWriteCloser, http.Header, error) {
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse connect URL: %s", err)
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	// the hub tells this transport from HTTP/2 by the negotiated protocol
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	dialer := &tls.Dialer{
+		Config: tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header = header.Clone()
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("write connect request: %s", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read connect response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, responseError(resp)
+	}
+	return &bufferedConn{Conn: conn, r: br}, resp.Header, nil
+}
+
+func (TLSTransport) Accept(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (io.ReadWriteCloser, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if r.ProtoMajor != 1 || !ok {
+		http.Error(w, "HTTP/1.1 is required", http.StatusBadRequest)
+		return nil, errors.New("not an HTTP/1.1 request")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to hijack connection: %s", err), http.StatusInternalServerError)
+		return nil, fmt.Errorf("hijack connection: %s", err)
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     responseHeader,
+	}
+	if err := resp.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write connect response: %s", err)
+	}
+	return &bufferedConn{Conn: conn, r: brw.Reader}, nil
+}
+
+// streamConn joins the request and response bodies of an HTTP/2 stream. On
+// the hub, done is closed once the connection is closed, as the handler
+// accepting the stream must not return earlier.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	closers   []io.Closer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for _, closer := range c.closers {
+			if e := closer.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	return err
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	mutex   sync.Mutex
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.w.Write(p)
+	if err == nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+// WaitClosed blocks until conn, as returned by Transport.Accept, is closed if
+// its transport requires the accepting handler to stay running.
+func WaitClosed(conn io.ReadWriteCloser) {
+	if c, ok := conn.(*streamConn); ok && c.done != nil {
+		<-c.done
+	}
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketSubprotocol is asked for by agents which carry the session in
+// WebSocket binary messages. Agents which do not ask for it use the
+// underlying connection of the WebSocket directly.
+const WebSocketSubprotocol = "kopilot.smartx.com/yamux"
+
+const (
+	webSocketPingInterval = 30 * time.Second
+	// webSocketPongWait is how long the connection may stay silent, pongs
+	// included, before it is considered broken.
+	webSocketPongWait  = 2*webSocketPingInterval + 10*time.Second
+	webSocketCloseWait = time.Second
+)
+
+// webSocketConn is a net.Conn carried in binary messages of a WebSocket, so
+// that intermediaries which parse WebSocket frames let it through. Each write
+// is sent as one message. The connection is pinged periodically and closed
+// if nothing, not even a pong, arrives in time.
+type webSocketConn struct {
+	*websocket.Conn
+	reader    io.Reader
+	done      chan struct{}
+	closeOnce sync.Once
+	writeMux  sync.Mutex
+}
+
+// NewWebSocketConn returns a net.Conn reading and writing binary messages of conn.
+func NewWebSocketConn(conn *websocket.Conn) net.Conn {
+	c := &webSocketConn{
+		Conn: conn,
+		done: make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	})
+	go c.keepalive()
+	return c
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.SetReadDeadline(time.Now().Add(webSocketPongWait))
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Close sends a close message before closing the underlying connection.
+func (c *webSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(webSocketCloseWait))
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *webSocketConn) keepalive() {
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketPongWait)); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
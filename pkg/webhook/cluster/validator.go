@@ -18,13 +18,17 @@ package cluster
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/url"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	kopilotv1alpha1 "github.com/smartxworks/kopilot/pkg/apis/kopilot/v1alpha1"
+	"github.com/smartxworks/kopilot/pkg/policy"
 )
 
 //+kubebuilder:webhook:path=/validate-v1alpha1-cluster,mutating=false,failurePolicy=fail,sideEffects=None,groups=kopilot.smartx.com,resources=clusters,verbs=create;update,versions=v1alpha1,name=validate.cluster.v1alpha1.kopilot.smartx.com,admissionReviewVersions={v1,v1beta1}
@@ -49,6 +53,60 @@ func (h *Validator) Handle(ctx context.Context, req admission.Request) admission
 	if cluster.Token == "" {
 		errs = append(errs, field.Required(field.NewPath("token"), ""))
 	}
+	if agent := cluster.Spec.Agent; agent != nil && agent.UpgradePolicy == kopilotv1alpha1.AgentUpgradePolicyPinned && agent.Image == "" {
+		errs = append(errs, field.Required(field.NewPath("spec", "agent", "image"), "required by the Pinned upgrade policy"))
+	}
+
+	for i, service := range cluster.Spec.Services {
+		if u, err := url.Parse(service.URL); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "services").Index(i).Child("url"), service.URL, err.Error()))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, field.NotSupported(field.NewPath("spec", "services").Index(i).Child("url"), u.Scheme, []string{"http", "https"}))
+		} else if u.Host == "" {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "services").Index(i).Child("url"), service.URL, "host is required"))
+		}
+	}
+
+	for i, endpoint := range cluster.Spec.Endpoints {
+		if _, _, err := net.SplitHostPort(endpoint.Address); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "endpoints").Index(i).Child("address"), endpoint.Address, err.Error()))
+		}
+	}
+
+	ports := map[int32]bool{}
+	for i, service := range cluster.Spec.HostServices {
+		if _, _, err := net.SplitHostPort(service.Address); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "hostServices").Index(i).Child("address"), service.Address, err.Error()))
+		}
+		if ports[service.Port] {
+			errs = append(errs, field.Duplicate(field.NewPath("spec", "hostServices").Index(i).Child("port"), service.Port))
+		}
+		ports[service.Port] = true
+	}
+
+	if session := cluster.Spec.Session; session != nil {
+		durations := []struct {
+			name     string
+			duration *metav1.Duration
+		}{
+			{"keepAliveInterval", session.KeepAliveInterval},
+			{"connectionWriteTimeout", session.ConnectionWriteTimeout},
+			{"streamOpenTimeout", session.StreamOpenTimeout},
+		}
+		for _, d := range durations {
+			if d.duration != nil && d.duration.Duration <= 0 {
+				errs = append(errs, field.Invalid(field.NewPath("spec", "session", d.name), d.duration.Duration.String(), "must be positive"))
+			}
+		}
+	}
+
+	if p := cluster.Spec.Policy; p != nil {
+		for i := range p.Rules {
+			if err := policy.FromClusterPolicyRule(&p.Rules[i]).Validate(); err != nil {
+				errs = append(errs, field.Required(field.NewPath("spec", "policy", "rules").Index(i), err.Error()))
+			}
+		}
+	}
 
 	if len(errs) > 0 {
 		return webhook.Denied(errs.ToAggregate().Error())